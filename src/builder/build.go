@@ -17,12 +17,14 @@
 package builder
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/solus-project/libosdev/disk"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 // CreateDirs creates any directories we may need later on
@@ -75,13 +77,13 @@ func (p *Package) CreateDirs(o *Overlay) error {
 
 // FetchSources will attempt to fetch the sources from the network
 // if necessary
-func (p *Package) FetchSources(o *Overlay) error {
+func (p *Package) FetchSources(ctx context.Context, o *Overlay) error {
 	for _, source := range p.Sources {
 		// Already fetched, skip it
 		if source.IsFetched() {
 			continue
 		}
-		if err := source.Fetch(); err != nil {
+		if err := source.Fetch(ctx); err != nil {
 			log.WithFields(log.Fields{
 				"error":  err,
 				"source": source.GetIdentifier(),
@@ -180,6 +182,39 @@ func (p *Package) BindCcache(o *Overlay) error {
 	return nil
 }
 
+// BuildHome returns the home directory of the build user within the chroot
+// for a ypkg build, which holds the work, source and ccache directories.
+func (p *Package) BuildHome() string {
+	if p.BuildDirName != "" {
+		return filepath.Join(BuildUserHome, p.BuildDirName)
+	}
+	return BuildUserHome
+}
+
+// SetBuildDir will build the package within the named directory of the build
+// user's home rather than the home directory itself.
+func (p *Package) SetBuildDir(name string) error {
+	if name == "." || name == ".." || strings.ContainsRune(name, os.PathSeparator) {
+		return ErrInvalidBuildDir
+	}
+	p.BuildDirName = name
+	return nil
+}
+
+// environment returns the environment for all processes run in the chroot
+func (p *Package) environment() []string {
+	var env []string
+	if p.Type == PackageTypeXML {
+		env = SaneEnvironment("root", "/root")
+	} else {
+		env = SaneEnvironment(BuildUser, p.BuildHome())
+	}
+	if p.Timezone != "" {
+		env = append(env, fmt.Sprintf("TZ=%s", p.Timezone))
+	}
+	return env
+}
+
 // GetWorkDir will return the externally visible work directory for the
 // given build type.
 func (p *Package) GetWorkDir(o *Overlay) string {
@@ -191,7 +226,7 @@ func (p *Package) GetWorkDirInternal() string {
 	if p.Type == PackageTypeXML {
 		return "/WORK"
 	}
-	return filepath.Join(BuildUserHome, "work")
+	return filepath.Join(p.BuildHome(), "work")
 }
 
 // GetSourceDir will return the externally visible work directory
@@ -205,7 +240,7 @@ func (p *Package) GetSourceDirInternal() string {
 	if p.Type == PackageTypeXML {
 		return "/var/cache/eopkg/archives"
 	}
-	return filepath.Join(BuildUserHome, "YPKG", "sources")
+	return filepath.Join(p.BuildHome(), "YPKG", "sources")
 }
 
 // GetCcacheDir will return the externally visible ccache directory
@@ -219,7 +254,7 @@ func (p *Package) GetCcacheDirInternal() string {
 	if p.Type == PackageTypeXML {
 		return "/root/.ccache"
 	}
-	return filepath.Join(BuildUserHome, ".ccache")
+	return filepath.Join(p.BuildHome(), ".ccache")
 }
 
 // CopyAssets will copy all of the required assets into the builder root
@@ -268,7 +303,7 @@ func (p *Package) CopyAssets(h *PackageHistory, o *Overlay) error {
 // PrepYpkg will do the initial leg work of preparing us for a ypkg build.
 func (p *Package) PrepYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager, overlay *Overlay, h *PackageHistory) error {
 	log.Debug("Writing packager file")
-	fp := filepath.Join(overlay.MountPoint, BuildUserHome, ".solus", "packager")
+	fp := filepath.Join(overlay.MountPoint, p.BuildHome(), ".solus", "packager")
 	fpd := filepath.Dir(fp)
 
 	if !PathExists(fpd) {
@@ -333,10 +368,11 @@ func (p *Package) PrepYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager,
 
 // BuildYpkg will take care of the ypkg specific build process and is called only
 // by Build()
-func (p *Package) BuildYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager, overlay *Overlay, h *PackageHistory) error {
+func (p *Package) BuildYpkg(notif EventNotifier, usr *UserInfo, pman *EopkgManager, overlay *Overlay, h *PackageHistory) error {
 	if err := p.PrepYpkg(notif, usr, pman, overlay, h); err != nil {
 		return err
 	}
+	notif.EmitEvent(EventDepsInstalled)
 
 	// Now kill networking
 	if !p.CanNetwork {
@@ -377,7 +413,8 @@ func (p *Package) BuildYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager
 	ymlFile := filepath.Join(wdir, filepath.Base(p.Path))
 
 	// Now build the package
-	cmd := fmt.Sprintf("/bin/su %s -- fakeroot ypkg-build -D %s %s", BuildUser, wdir, ymlFile)
+	// ypkg builds within $HOME/YPKG, so this moves the build itself too
+	cmd := fmt.Sprintf("/bin/su %s -- fakeroot env HOME=%s ypkg-build -D %s %s", BuildUser, p.BuildHome(), wdir, ymlFile)
 	if DisableColors {
 		cmd += " -n"
 	}
@@ -386,9 +423,12 @@ func (p *Package) BuildYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager
 		cmd += fmt.Sprintf(" -t %v", h.GetLastVersionTimestamp())
 	}
 
+	p.writePackagesManifest(overlay)
+
 	log.WithFields(log.Fields{
 		"package": p.Name,
 	}).Info("Now starting build of package")
+	notif.EmitEvent(EventBuildStarted)
 	if err := ChrootExec(notif, overlay.MountPoint, cmd); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
@@ -396,12 +436,13 @@ func (p *Package) BuildYpkg(notif PidNotifier, usr *UserInfo, pman *EopkgManager
 		return err
 	}
 	notif.SetActivePID(0)
+	notif.EmitEvent(EventBuildFinished)
 	return nil
 }
 
 // BuildXML will take care of building the legacy pspec.xml format, and is called only
 // by Build()
-func (p *Package) BuildXML(notif PidNotifier, pman *EopkgManager, overlay *Overlay) error {
+func (p *Package) BuildXML(notif EventNotifier, pman *EopkgManager, overlay *Overlay) error {
 	// Just straight up build it with eopkg
 	log.Warning("Full sandboxing is not possible with legacy format")
 
@@ -427,9 +468,12 @@ func (p *Package) BuildXML(notif PidNotifier, pman *EopkgManager, overlay *Overl
 	// Now build the package, ignore-sandbox in case someone is stupid
 	// and activates it in eopkg.conf..
 	cmd := eopkgCommand(fmt.Sprintf("eopkg build --ignore-sandbox --yes-all -O %s %s", wdir, xmlFile))
+	p.writePackagesManifest(overlay)
+
 	log.WithFields(log.Fields{
 		"package": p.Name,
 	}).Info("Now starting build of package")
+	notif.EmitEvent(EventBuildStarted)
 	if err := ChrootExec(notif, overlay.MountPoint, cmd); err != nil {
 		log.WithFields(log.Fields{
 			"error": err,
@@ -437,6 +481,7 @@ func (p *Package) BuildXML(notif PidNotifier, pman *EopkgManager, overlay *Overl
 		return err
 	}
 	notif.SetActivePID(0)
+	notif.EmitEvent(EventBuildFinished)
 
 	// Now we can stop dbus..
 	log.Debug("Stopping D-BUS")
@@ -498,43 +543,63 @@ func (p *Package) CollectAssets(overlay *Overlay, usr *UserInfo, manifestTarget
 	}).Debug("Collecting files")
 
 	for _, p := range collections {
-		tgt, err := filepath.Abs(filepath.Join(".", filepath.Base(p)))
-		if err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-			}).Error("Unable to find working directory!")
+		if err := collectFile(p, filepath.Base(p), usr); err != nil {
 			return err
 		}
+	}
+
+	return p.CollectPackagesManifest(overlay, usr)
+}
+
+// CollectLog will copy the build log, if one is being kept, back to the
+// users current directory as $name-$version-$release.log
+func (p *Package) CollectLog(overlay *Overlay, usr *UserInfo) error {
+	if overlay.LogPath == "" || !PathExists(overlay.LogPath) {
+		return nil
+	}
+	logFile := fmt.Sprintf("%s-%s-%d%s", p.Name, p.Version, p.Release, BuildLogSuffix)
+	return collectFile(overlay.LogPath, logFile, usr)
+}
 
+// collectFile will copy the given file into the current directory under the
+// new name, and then attempt to restore ownership to the invoking user.
+func collectFile(path, name string, usr *UserInfo) error {
+	tgt, err := filepath.Abs(filepath.Join(".", name))
+	if err != nil {
 		log.WithFields(log.Fields{
-			"file": filepath.Base(p),
-		}).Debug("Collecting build artifact")
+			"error": err,
+		}).Error("Unable to find working directory!")
+		return err
+	}
 
-		if err := disk.CopyFile(p, tgt); err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-			}).Error("Unable to collect build file")
-			return err
-		}
+	log.WithFields(log.Fields{
+		"file": name,
+	}).Debug("Collecting build artifact")
 
+	if err := disk.CopyFile(path, tgt); err != nil {
 		log.WithFields(log.Fields{
-			"uid":  usr.UID,
-			"gid":  usr.GID,
-			"file": filepath.Base(p),
-		}).Debug("Setting file ownership for current user")
+			"error": err,
+		}).Error("Unable to collect build file")
+		return err
+	}
 
-		if err = os.Chown(tgt, usr.UID, usr.GID); err != nil {
-			log.WithFields(log.Fields{
-				"error": err,
-				"file":  filepath.Base(p),
-			}).Error("Error in restoring file ownership")
-		}
+	log.WithFields(log.Fields{
+		"uid":  usr.UID,
+		"gid":  usr.GID,
+		"file": name,
+	}).Debug("Setting file ownership for current user")
+
+	if err = os.Chown(tgt, usr.UID, usr.GID); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"file":  name,
+		}).Error("Error in restoring file ownership")
 	}
 	return nil
 }
 
 // Build will attempt to build the package in the overlayfs system
-func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Profile, pman *EopkgManager, overlay *Overlay, manifestTarget string) error {
+func (p *Package) Build(ctx context.Context, notif EventNotifier, history *PackageHistory, profile *Profile, pman *EopkgManager, overlay *Overlay, manifestTarget string) error {
 	log.WithFields(log.Fields{
 		"profile": overlay.Back.Name,
 		"version": p.Version,
@@ -545,13 +610,7 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 
 	usr := GetUserInfo()
 
-	var env []string
-	if p.Type == PackageTypeXML {
-		env = SaneEnvironment("root", "/root")
-	} else {
-		env = SaneEnvironment(BuildUser, BuildUserHome)
-	}
-	ChrootEnvironment = env
+	ChrootEnvironment = p.environment()
 
 	// Set up environment
 	if err := overlay.CleanExisting(); err != nil {
@@ -562,6 +621,7 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 	if err := p.ActivateRoot(overlay); err != nil {
 		return err
 	}
+	notif.EmitEvent(EventOverlayMounted)
 
 	// Ensure source assets are in place
 	if err := p.CopyAssets(history, overlay); err != nil {
@@ -572,9 +632,10 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 	}
 
 	log.Debug("Validating sources")
-	if err := p.FetchSources(overlay); err != nil {
+	if err := p.FetchSources(ctx, overlay); err != nil {
 		return err
 	}
+	notif.EmitEvent(EventSourcesFetched)
 
 	// Set up package manager
 	if err := pman.Init(); err != nil {
@@ -597,6 +658,7 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 		}).Error("Configuring repositories failed")
 		return err
 	}
+	notif.EmitEvent(EventReposConfigured)
 
 	log.Debug("Upgrading system base")
 	if err := pman.Upgrade(); err != nil {
@@ -605,6 +667,7 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 		}).Error("Failed to upgrade rootfs")
 		return err
 	}
+	notif.EmitEvent(EventBaseUpgraded)
 
 	log.Debug("Asserting system.devel component installation")
 	if err := pman.InstallComponent("system.devel"); err != nil {
@@ -613,6 +676,7 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 		}).Error("Failed to assert system.devel")
 		return err
 	}
+	notif.EmitEvent(EventComponentsInstalled)
 
 	// Ensure all directories are in place
 	if err := p.CreateDirs(overlay); err != nil {
@@ -630,5 +694,9 @@ func (p *Package) Build(notif PidNotifier, history *PackageHistory, profile *Pro
 		}
 	}
 
-	return p.CollectAssets(overlay, usr, manifestTarget)
+	if err := p.CollectAssets(overlay, usr, manifestTarget); err != nil {
+		return err
+	}
+	notif.EmitEvent(EventArtifactsCollected)
+	return nil
 }
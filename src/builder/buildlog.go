@@ -0,0 +1,146 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// BuildLogSuffix is the suffix used for collected build logs
+	BuildLogSuffix = ".log"
+
+	// BuildLogTimeFormat is the timestamp format used for each log line
+	BuildLogTimeFormat = "15:04:05"
+)
+
+// A BuildLog captures all output from the processes run inside the build
+// root, stamping each line with the time it was written, and marks each
+// phase of the build as it is reached.
+type BuildLog struct {
+	path string
+	fd   *os.File
+	lock *sync.Mutex
+
+	stdout *buildLogStream
+	stderr *buildLogStream
+}
+
+// buildLogStream is a single stream (stdout or stderr) feeding into the
+// BuildLog, which has to track whether it is at the start of a line.
+type buildLogStream struct {
+	log       *BuildLog
+	lineStart bool
+}
+
+// NewBuildLog will create (or truncate) the log file at the given path
+func NewBuildLog(path string) (*BuildLog, error) {
+	fd, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &BuildLog{
+		path: path,
+		fd:   fd,
+		lock: new(sync.Mutex),
+	}
+	l.stdout = &buildLogStream{log: l, lineStart: true}
+	l.stderr = &buildLogStream{log: l, lineStart: true}
+	return l, nil
+}
+
+// Write will stamp the start of each new line in p with the current time
+// before passing it through to the log file.
+func (s *buildLogStream) Write(p []byte) (int, error) {
+	s.log.lock.Lock()
+	defer s.log.lock.Unlock()
+
+	if s.log.fd == nil {
+		return len(p), nil
+	}
+
+	var buf bytes.Buffer
+	stamp := fmt.Sprintf("[%s] ", time.Now().Format(BuildLogTimeFormat))
+
+	for _, b := range p {
+		if s.lineStart {
+			buf.WriteString(stamp)
+			s.lineStart = false
+		}
+		buf.WriteByte(b)
+		if b == '\n' {
+			s.lineStart = true
+		}
+	}
+
+	if _, err := s.log.fd.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Stdout returns a writer that sends output to both the real stdout and
+// the log file.
+func (l *BuildLog) Stdout() io.Writer {
+	return io.MultiWriter(os.Stdout, l.stdout)
+}
+
+// Stderr returns a writer that sends output to both the real stderr and
+// the log file.
+func (l *BuildLog) Stderr() io.Writer {
+	return io.MultiWriter(os.Stderr, l.stderr)
+}
+
+// HandleEvent will write a section marker into the log for each phase
+func (l *BuildLog) HandleEvent(e *Event) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.fd == nil {
+		return
+	}
+
+	marker := fmt.Sprintf("\n==> [%s] %s", e.Time.Local().Format(BuildLogTimeFormat), e.Type)
+	if e.Error != "" {
+		marker += fmt.Sprintf(": %s", e.Error)
+	}
+	fmt.Fprintf(l.fd, "%s\n\n", marker)
+
+	// Marker always leaves us on a fresh line
+	l.stdout.lineStart = true
+	l.stderr.lineStart = true
+}
+
+// Close will flush and close the underlying log file. Any further writes
+// to the log are silently discarded.
+func (l *BuildLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.fd == nil {
+		return nil
+	}
+	l.fd.Sync()
+	err := l.fd.Close()
+	l.fd = nil
+	return err
+}
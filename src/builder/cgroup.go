@@ -0,0 +1,283 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// CgroupMount is where the unified (v2) cgroup hierarchy is mounted
+	CgroupMount = "/sys/fs/cgroup"
+
+	// CgroupCPUPeriod is the period, in microseconds, used for the CPU quota
+	CgroupCPUPeriod = 100000
+)
+
+var (
+	// CgroupRoot is the parent of all build cgroups
+	CgroupRoot = filepath.Join(CgroupMount, "solbuild")
+
+	// ErrNoCgroup2 is returned when resource limits are requested on a host
+	// without the unified cgroup hierarchy
+	ErrNoCgroup2 = errors.New("Resource limits require the unified cgroup (v2) hierarchy")
+
+	// ErrMemoryLimit is returned when the build was killed for exceeding its
+	// memory limit
+	ErrMemoryLimit = errors.New("The build exceeded its memory limit")
+
+	// ErrPidsLimit is returned when the build hit its process limit
+	ErrPidsLimit = errors.New("The build exceeded its process limit")
+)
+
+// A Cgroup is created for each overlay to apply the resource limits to all
+// processes run within the build root.
+type Cgroup struct {
+	Path   string         // Path to the cgroup within the hierarchy
+	Limits ResourceLimits // Limits applied to the cgroup
+}
+
+// A cgroupNotifier is a PidNotifier that confines the processes it starts to
+// a cgroup, returning its path, or an empty string if there is none.
+type cgroupNotifier interface {
+	CgroupPath() string
+}
+
+// NewCgroup will return a cgroup with the given name, i.e. the profile and
+// package of a build. It is not created until Create is called.
+func NewCgroup(name string, limits ResourceLimits) *Cgroup {
+	return &Cgroup{
+		Path:   filepath.Join(CgroupRoot, name),
+		Limits: limits,
+	}
+}
+
+// cgroupPath returns the cgroup that processes started for the notifier must
+// be run in, if any.
+func cgroupPath(notif PidNotifier) string {
+	if c, ok := notif.(cgroupNotifier); ok {
+		return c.CgroupPath()
+	}
+	return ""
+}
+
+// cgroupCommand returns the command to run name with args inside the cgroup
+// at path. The shell moves itself into the cgroup before exec'ing the command,
+// so that nothing it starts can fork before the limits apply.
+func cgroupCommand(path, name string, args ...string) *exec.Cmd {
+	if path == "" {
+		return exec.Command(name, args...)
+	}
+	procs := filepath.Join(path, "cgroup.procs")
+	return exec.Command("/bin/sh", append([]string{"-c", `echo $$ > "$0" && exec "$@"`, procs, name}, args...)...)
+}
+
+// ParseMemorySize will parse a memory size with an optional K, M, G or T
+// suffix, returning the size in bytes.
+func ParseMemorySize(orig string) (int64, error) {
+	size := strings.ToUpper(strings.TrimSpace(orig))
+	mult := int64(1)
+
+	if size != "" {
+		switch size[len(size)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult != 1 {
+			size = size[:len(size)-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Invalid memory size: '%s'", orig)
+	}
+	return n * mult, nil
+}
+
+// writeControl will write the value to the named control file of the cgroup
+func writeControl(dir, control, value string) error {
+	return ioutil.WriteFile(filepath.Join(dir, control), []byte(value), 00644)
+}
+
+// enableControllers will enable the controllers we need for all children of
+// the given cgroup.
+func enableControllers(dir string) error {
+	for _, c := range []string{"memory", "cpu", "pids"} {
+		if err := writeControl(dir, "cgroup.subtree_control", "+"+c); err != nil {
+			return fmt.Errorf("Failed to enable %s controller in %s: %v", c, dir, err)
+		}
+	}
+	return nil
+}
+
+// Create will create the cgroup and apply the limits to it. Any existing
+// cgroup from an earlier build is destroyed first.
+func (c *Cgroup) Create() error {
+	if !PathExists(filepath.Join(CgroupMount, "cgroup.controllers")) {
+		return ErrNoCgroup2
+	}
+
+	if err := os.MkdirAll(CgroupRoot, 00755); err != nil {
+		return err
+	}
+	if err := enableControllers(CgroupMount); err != nil {
+		return err
+	}
+	if err := enableControllers(CgroupRoot); err != nil {
+		return err
+	}
+
+	if PathExists(c.Path) {
+		if err := c.Destroy(); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(c.Path, 00755); err != nil {
+		return err
+	}
+
+	if c.Limits.Memory != "" {
+		mem, err := ParseMemorySize(c.Limits.Memory)
+		if err != nil {
+			return err
+		}
+		if err := writeControl(c.Path, "memory.max", strconv.FormatInt(mem, 10)); err != nil {
+			return err
+		}
+		// Don't let the build escape the limit into swap
+		writeControl(c.Path, "memory.swap.max", "0")
+	}
+
+	if c.Limits.CPUs > 0 {
+		quota := int64(c.Limits.CPUs * CgroupCPUPeriod)
+		if err := writeControl(c.Path, "cpu.max", fmt.Sprintf("%d %d", quota, CgroupCPUPeriod)); err != nil {
+			return err
+		}
+	}
+
+	if c.Limits.MaxPids > 0 {
+		if err := writeControl(c.Path, "pids.max", strconv.Itoa(c.Limits.MaxPids)); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"cgroup":   c.Path,
+		"memory":   c.Limits.Memory,
+		"cpus":     c.Limits.CPUs,
+		"max_pids": c.Limits.MaxPids,
+	}).Debug("Created build cgroup")
+	return nil
+}
+
+// MemoryPeak will return the most memory, in bytes, used at once by all of
+// the processes in the cgroup, which requires Linux 5.19 or newer.
+func (c *Cgroup) MemoryPeak() (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(c.Path, "memory.peak"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readEvent will return the count for the key in the given events file
+func (c *Cgroup) readEvent(control, key string) int {
+	data, err := ioutil.ReadFile(filepath.Join(c.Path, control))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != key {
+			continue
+		}
+		n, _ := strconv.Atoi(fields[1])
+		return n
+	}
+	return 0
+}
+
+// Breach will return the error for whichever limit has been breached, if any
+func (c *Cgroup) Breach() error {
+	if c.readEvent("memory.events", "oom_kill") > 0 {
+		return ErrMemoryLimit
+	}
+	if c.readEvent("pids.events", "max") > 0 {
+		return ErrPidsLimit
+	}
+	return nil
+}
+
+// pids returns all processes currently within the cgroup
+func (c *Cgroup) pids() []int {
+	data, err := ioutil.ReadFile(filepath.Join(c.Path, "cgroup.procs"))
+	if err != nil {
+		return nil
+	}
+	var ret []int
+	for _, f := range strings.Fields(string(data)) {
+		if pid, err := strconv.Atoi(f); err == nil {
+			ret = append(ret, pid)
+		}
+	}
+	return ret
+}
+
+// Kill will kill every process within the cgroup
+func (c *Cgroup) Kill() {
+	if !PathExists(c.Path) {
+		return
+	}
+	// Kernels since 5.14 can do this for us in one go
+	if writeControl(c.Path, "cgroup.kill", "1") == nil {
+		return
+	}
+	for _, pid := range c.pids() {
+		syscall.Kill(pid, syscall.SIGKILL)
+	}
+}
+
+// Destroy will kill every process within the cgroup and remove it
+func (c *Cgroup) Destroy() error {
+	if !PathExists(c.Path) {
+		return nil
+	}
+	c.Kill()
+
+	// Give the kernel a moment to reap everything
+	for i := 0; i < 20 && len(c.pids()) > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return os.Remove(c.Path)
+}
@@ -0,0 +1,94 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseMemorySize(t *testing.T) {
+	good := map[string]int64{
+		"4096": 4096,
+		"512k": 512 << 10,
+		"8G":   8 << 30,
+		" 2M ": 2 << 20,
+	}
+	for size, expected := range good {
+		n, err := ParseMemorySize(size)
+		if err != nil {
+			t.Fatalf("Failed to parse valid size '%s': %v", size, err)
+		}
+		if n != expected {
+			t.Fatalf("Wrong size for '%s': %d vs expected %d", size, n, expected)
+		}
+	}
+	for _, size := range []string{"", "G", "-1G", "lots"} {
+		if _, err := ParseMemorySize(size); err == nil {
+			t.Fatalf("Should not be able to parse invalid size '%s'", size)
+		}
+	}
+}
+
+func TestCgroupBreach(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "solbuild-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	c := &Cgroup{Path: tmp}
+	if err := c.Breach(); err != nil {
+		t.Fatalf("Cgroup without events should not be breached: %v", err)
+	}
+
+	events := "low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n"
+	ioutil.WriteFile(filepath.Join(tmp, "memory.events"), []byte(events), 00644)
+	ioutil.WriteFile(filepath.Join(tmp, "pids.events"), []byte("max 2\n"), 00644)
+	if err := c.Breach(); err != ErrPidsLimit {
+		t.Fatalf("Expected process limit breach, got: %v", err)
+	}
+
+	events = "low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"
+	ioutil.WriteFile(filepath.Join(tmp, "memory.events"), []byte(events), 00644)
+	if err := c.Breach(); err != ErrMemoryLimit {
+		t.Fatalf("Expected memory limit breach, got: %v", err)
+	}
+}
+
+func TestCgroupCommand(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "solbuild-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// The command must replace the shell that entered the cgroup
+	out, err := cgroupCommand(tmp, "/bin/sh", "-c", "echo $$").Output()
+	if err != nil {
+		t.Fatalf("Failed to run command in cgroup: %v", err)
+	}
+	procs, err := ioutil.ReadFile(filepath.Join(tmp, "cgroup.procs"))
+	if err != nil {
+		t.Fatalf("Command did not enter the cgroup: %v", err)
+	}
+	if string(procs) != string(out) {
+		t.Fatalf("Wrong process entered the cgroup: %s vs %s", procs, out)
+	}
+}
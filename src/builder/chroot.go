@@ -23,8 +23,10 @@ import (
 	"os"
 )
 
-// Chroot will attempt to spawn a chroot in the overlayfs system
-func (p *Package) Chroot(notif PidNotifier, pman *EopkgManager, overlay *Overlay) error {
+// Chroot will attempt to spawn a chroot in the overlayfs system. When resuming
+// a root kept from a failed build, the sources and ccache are made available
+// again so that the build can be continued by hand.
+func (p *Package) Chroot(notif PidNotifier, pman *EopkgManager, overlay *Overlay, resume bool) error {
 	log.WithFields(log.Fields{
 		"profile": overlay.Back.Name,
 		"version": p.Version,
@@ -33,18 +35,21 @@ func (p *Package) Chroot(notif PidNotifier, pman *EopkgManager, overlay *Overlay
 		"release": p.Release,
 	}).Debug("Beginning chroot")
 
-	var env []string
-	if p.Type == PackageTypeXML {
-		env = SaneEnvironment("root", "/root")
-	} else {
-		env = SaneEnvironment(BuildUser, BuildUserHome)
-	}
-	ChrootEnvironment = env
+	ChrootEnvironment = p.environment()
 
 	if err := p.ActivateRoot(overlay); err != nil {
 		return err
 	}
 
+	if resume {
+		if err := p.BindSources(overlay); err != nil {
+			return err
+		}
+		if err := p.BindCcache(overlay); err != nil {
+			return err
+		}
+	}
+
 	// Now kill networking
 	if p.Type == PackageTypeYpkg {
 		if !p.CanNetwork {
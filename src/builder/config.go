@@ -22,13 +22,73 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // Config defines the global defaults for solbuild
 type Config struct {
-	DefaultProfile string `toml:"default_profile"` // Name of the default profile to use
-	EnableTmpfs    bool   `toml:"enable_tmpfs"`    // Whether to enable tmpfs builds or
-	TmpfsSize      string `toml:"tmpfs_size"`      // Bounding size on the tmpfs
+	DefaultProfile string         `toml:"default_profile"`  // Name of the default profile to use
+	EnableTmpfs    bool           `toml:"enable_tmpfs"`     // Whether to enable tmpfs builds or
+	TmpfsSize      string         `toml:"tmpfs_size"`       // Bounding size on the tmpfs
+	BuildTimeout   string         `toml:"build_timeout"`    // Default maximum duration of a build
+	Limits         ResourceLimits `toml:"limits"`           // Resource limits for all builds
+	ImageMirrors   []string       `toml:"image_mirrors"`    // Alternative base URIs for images
+	ImageSnapshots int            `toml:"image_snapshots"`  // Previous generations of each image to keep
+	MaxImageAge    string         `toml:"max_image_age"`    // Age after which images are refreshed before builds
+	ImageAgePolicy string         `toml:"image_age_policy"` // What to do with images older than MaxImageAge
+
+	Images map[string]*ImageDefinition `toml:"images"` // Images in addition to those published by Solus
+}
+
+const (
+	// ImageAgeUpdate will update images that are too old before building
+	ImageAgeUpdate = "update"
+
+	// ImageAgeWarn will only warn about images that are too old
+	ImageAgeWarn = "warn"
+)
+
+// MaxAge returns the configured maximum image age, or zero if there is none
+func (c *Config) MaxAge() (time.Duration, error) {
+	if c.MaxImageAge == "" {
+		return 0, nil
+	}
+	return ParseAge(c.MaxImageAge)
+}
+
+// Timeout returns the configured build timeout, or zero if there is none
+func (c *Config) Timeout() (time.Duration, error) {
+	if c.BuildTimeout == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(c.BuildTimeout)
+}
+
+// ResourceLimits bound the resources available to the processes of a build.
+// A zero value for any limit leaves that resource unbounded.
+type ResourceLimits struct {
+	Memory  string  `toml:"memory"`   // Memory limit, i.e. 8G
+	CPUs    float64 `toml:"cpus"`     // Number of CPUs worth of time, may be fractional
+	MaxPids int     `toml:"max_pids"` // Maximum number of processes
+}
+
+// IsEmpty will determine whether any limits are set
+func (l ResourceLimits) IsEmpty() bool {
+	return l.Memory == "" && l.CPUs == 0 && l.MaxPids == 0
+}
+
+// Merge returns the limits with any limits set in o taking precedence
+func (l ResourceLimits) Merge(o ResourceLimits) ResourceLimits {
+	if o.Memory != "" {
+		l.Memory = o.Memory
+	}
+	if o.CPUs != 0 {
+		l.CPUs = o.CPUs
+	}
+	if o.MaxPids != 0 {
+		l.MaxPids = o.MaxPids
+	}
+	return l
 }
 
 var (
@@ -50,6 +110,8 @@ func NewConfig() (*Config, error) {
 		DefaultProfile: "main-x86_64",
 		EnableTmpfs:    false,
 		TmpfsSize:      "",
+		ImageSnapshots: DefaultImageSnapshots,
+		ImageAgePolicy: ImageAgeUpdate,
 	}
 
 	// Reverse because /etc takes precedence in stateless
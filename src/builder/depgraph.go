@@ -0,0 +1,286 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// AutomaticSubPackages are the subpackages ypkg may emit for any package
+	// without them being explicitly listed in the patterns.
+	AutomaticSubPackages = []string{
+		"devel",
+		"32bit",
+		"32bit-devel",
+		"dbginfo",
+	}
+)
+
+// Provides will return the names of all packages we expect this build to
+// produce.
+func (p *Package) Provides() []string {
+	ret := []string{p.Name}
+	for _, sub := range AutomaticSubPackages {
+		ret = append(ret, fmt.Sprintf("%s-%s", p.Name, sub))
+	}
+	return append(ret, p.SubPackages...)
+}
+
+// IsPkgconfigDep will determine whether the build dependency is a pkgconfig()
+// or pkgconfig32() dependency, which cannot be resolved prior to a build.
+func IsPkgconfigDep(dep string) bool {
+	return strings.HasPrefix(dep, "pkgconfig(") || strings.HasPrefix(dep, "pkgconfig32(")
+}
+
+// pkgconfigCandidates returns the names of the packages likely to provide
+// the pkgconfig() or pkgconfig32() dependency, most likely first. The module
+// is usually shipped in the -devel subpackage of the package of the same
+// name, with or without a lib prefix.
+func pkgconfigCandidates(dep string) []string {
+	emul32 := strings.HasPrefix(dep, "pkgconfig32(")
+	module := strings.TrimSuffix(dep[strings.Index(dep, "(")+1:], ")")
+	bases := []string{module}
+	if !strings.HasPrefix(module, "lib") {
+		bases = append(bases, "lib"+module)
+	}
+	var ret []string
+	for _, base := range bases {
+		if emul32 {
+			ret = append(ret, base+"-32bit-devel", base+"-32bit")
+		} else {
+			ret = append(ret, base+"-devel", base)
+		}
+	}
+	return ret
+}
+
+// A BuildGraph tracks the build dependencies between a set of packages, so
+// that they can be built in an order that satisfies each of them.
+type BuildGraph struct {
+	Packages []*Package
+
+	providers map[string]*Package     // Package name to the build producing it
+	deps      map[*Package][]*Package // Dependencies within the set
+	external  map[*Package][]string   // Dependencies not satisfied by the set
+}
+
+// NewBuildGraph will resolve the build dependencies of each of the given
+// packages against the rest of the set.
+func NewBuildGraph(pkgs []*Package) *BuildGraph {
+	g := &BuildGraph{
+		Packages:  pkgs,
+		providers: make(map[string]*Package),
+		deps:      make(map[*Package][]*Package),
+		external:  make(map[*Package][]string),
+	}
+
+	for _, p := range pkgs {
+		for _, name := range p.Provides() {
+			if _, ok := g.providers[name]; !ok {
+				g.providers[name] = p
+			}
+		}
+	}
+
+	for _, p := range pkgs {
+		seen := make(map[*Package]bool)
+		for _, dep := range p.BuildDeps {
+			provider, ok := g.resolve(dep)
+			if !ok {
+				g.external[p] = append(g.external[p], dep)
+				continue
+			}
+			// Don't depend on ourselves, i.e. bootstrapping via -devel
+			if provider == p || seen[provider] {
+				continue
+			}
+			seen[provider] = true
+			g.deps[p] = append(g.deps[p], provider)
+		}
+	}
+	return g
+}
+
+// resolve will find the package in the set that builds the dependency
+func (g *BuildGraph) resolve(dep string) (*Package, bool) {
+	if !IsPkgconfigDep(dep) {
+		p, ok := g.providers[dep]
+		return p, ok
+	}
+	for _, name := range pkgconfigCandidates(dep) {
+		if p, ok := g.providers[name]; ok {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// Dependencies returns the packages in the set which p depends on
+func (g *BuildGraph) Dependencies(p *Package) []*Package {
+	return g.deps[p]
+}
+
+// External returns the build dependencies of p that are not built by
+// any package in the set.
+func (g *BuildGraph) External(p *Package) []string {
+	return g.external[p]
+}
+
+// Missing returns the external build dependencies of p which are not in
+// known. pkgconfig dependencies are never reported, as they can't be
+// resolved against package names, see Unresolved.
+func (g *BuildGraph) Missing(p *Package, known map[string]bool) []string {
+	var ret []string
+	for _, dep := range g.external[p] {
+		if !IsPkgconfigDep(dep) && !known[dep] {
+			ret = append(ret, dep)
+		}
+	}
+	return ret
+}
+
+// Unresolved returns the pkgconfig dependencies of p that could not be
+// matched to any package in the set. If the set does provide them, the
+// packages may be built in the wrong order.
+func (g *BuildGraph) Unresolved(p *Package) []string {
+	var ret []string
+	for _, dep := range g.external[p] {
+		if IsPkgconfigDep(dep) {
+			ret = append(ret, dep)
+		}
+	}
+	return ret
+}
+
+// Order will return the packages sorted such that each package comes after
+// all of its dependencies. Packages with no ordering constraints between
+// them keep their original relative order.
+func (g *BuildGraph) Order() ([]*Package, error) {
+	var ret []*Package
+	done := make(map[*Package]bool)
+
+	for len(ret) < len(g.Packages) {
+		progress := false
+		for _, p := range g.Packages {
+			if done[p] {
+				continue
+			}
+			ready := true
+			for _, dep := range g.deps[p] {
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+			done[p] = true
+			ret = append(ret, p)
+			progress = true
+		}
+		if !progress {
+			return nil, fmt.Errorf("Dependency cycle: %s", g.describeCycle(done))
+		}
+	}
+	return ret, nil
+}
+
+// describeCycle walks from the first unbuildable package until it finds
+// a package it has already visited, and returns that loop in a readable form.
+func (g *BuildGraph) describeCycle(done map[*Package]bool) string {
+	var p *Package
+	for _, pkg := range g.Packages {
+		if !done[pkg] {
+			p = pkg
+			break
+		}
+	}
+
+	var path []*Package
+	visited := make(map[*Package]int)
+	for p != nil {
+		if idx, ok := visited[p]; ok {
+			path = append(path[idx:], p)
+			break
+		}
+		visited[p] = len(path)
+		path = append(path, p)
+
+		var next *Package
+		for _, dep := range g.deps[p] {
+			if !done[dep] {
+				next = dep
+				break
+			}
+		}
+		p = next
+	}
+
+	var names []string
+	for _, pkg := range path {
+		names = append(names, pkg.Name)
+	}
+	return strings.Join(names, " -> ")
+}
+
+// EopkgNameFromFile will return the package name for the given .eopkg file,
+// which always has the form name-version-release-distrelease-arch.eopkg
+func EopkgNameFromFile(path string) string {
+	base := strings.TrimSuffix(filepath.Base(path), ".eopkg")
+	fields := strings.Split(base, "-")
+	if len(fields) < 5 {
+		return base
+	}
+	return strings.Join(fields[:len(fields)-4], "-")
+}
+
+// RepoIndexPackages returns the names of all packages in each repo index of
+// the root, keyed by the repo name.
+func RepoIndexPackages(root string) (map[string][]string, error) {
+	indexes, err := filepath.Glob(filepath.Join(root, EopkgIndexDir, "*", "eopkg-index.xml"))
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]string)
+	for _, path := range indexes {
+		var index eopkgIndex
+		if err := readXML(path, &index); err != nil {
+			return nil, fmt.Errorf("Invalid repo index %s: %v", path, err)
+		}
+		repo := filepath.Base(filepath.Dir(path))
+		for _, p := range index.Packages {
+			ret[repo] = append(ret[repo], p.Name)
+		}
+	}
+	return ret, nil
+}
+
+// RepoPackages will mount the image read-only on a temporary directory and
+// return the names of all packages in each of its repo indexes.
+func (b *BackingImage) RepoPackages() (map[string][]string, error) {
+	var pkgs map[string][]string
+	err := b.mountReadOnly(func(root string) error {
+		var err error
+		pkgs, err = RepoIndexPackages(root)
+		return err
+	})
+	return pkgs, err
+}
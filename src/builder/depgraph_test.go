@@ -0,0 +1,111 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildGraphOrder(t *testing.T) {
+	app := &Package{Name: "app", BuildDeps: []string{"libfoo-devel", "pkgconfig(gtk+-3.0)"}}
+	libfoo := &Package{Name: "libfoo", BuildDeps: []string{"libbar"}}
+	libbar := &Package{Name: "libbar-src", SubPackages: []string{"libbar"}}
+	other := &Package{Name: "other"}
+
+	g := NewBuildGraph([]*Package{app, libfoo, other, libbar})
+	order, err := g.Order()
+	if err != nil {
+		t.Fatalf("Failed to order valid graph: %v", err)
+	}
+
+	var names []string
+	for _, p := range order {
+		names = append(names, p.Name)
+	}
+	if got := strings.Join(names, " "); got != "other libbar-src libfoo app" {
+		t.Fatalf("Wrong build order: %s", got)
+	}
+
+	if ext := g.External(app); len(ext) != 1 || ext[0] != "pkgconfig(gtk+-3.0)" {
+		t.Fatalf("Wrong external dependencies: %v", ext)
+	}
+	if deps := g.Dependencies(libfoo); len(deps) != 1 || deps[0] != libbar {
+		t.Fatalf("Wrong dependencies for libfoo: %v", deps)
+	}
+}
+
+func TestBuildGraphPkgconfig(t *testing.T) {
+	app := &Package{Name: "app", BuildDeps: []string{"pkgconfig(foo)", "pkgconfig32(zlib)", "pkgconfig(gtk+-3.0)"}}
+	libfoo := &Package{Name: "libfoo"}
+	zlib := &Package{Name: "zlib"}
+
+	g := NewBuildGraph([]*Package{app, libfoo, zlib})
+	order, err := g.Order()
+	if err != nil {
+		t.Fatalf("Failed to order valid graph: %v", err)
+	}
+	if order[len(order)-1] != app {
+		t.Fatalf("pkgconfig dependencies should be built first, got: %v", order)
+	}
+	if deps := g.Dependencies(app); len(deps) != 2 || deps[0] != libfoo || deps[1] != zlib {
+		t.Fatalf("Wrong dependencies for app: %v", deps)
+	}
+	if unresolved := g.Unresolved(app); len(unresolved) != 1 || unresolved[0] != "pkgconfig(gtk+-3.0)" {
+		t.Fatalf("Wrong unresolved dependencies: %v", unresolved)
+	}
+}
+
+func TestBuildGraphCycle(t *testing.T) {
+	a := &Package{Name: "a", BuildDeps: []string{"b-devel"}}
+	b := &Package{Name: "b", BuildDeps: []string{"c"}}
+	c := &Package{Name: "c", BuildDeps: []string{"b"}}
+
+	g := NewBuildGraph([]*Package{a, b, c})
+	if _, err := g.Order(); err == nil {
+		t.Fatal("Failed to detect dependency cycle")
+	} else if !strings.Contains(err.Error(), "b -> c -> b") {
+		t.Fatalf("Wrong cycle reported: %v", err)
+	}
+}
+
+func TestBuildGraphMissing(t *testing.T) {
+	app := &Package{Name: "app", BuildDeps: []string{"libfoo-devel", "libbar-devel", "glib2-devel", "pkgconfig(gtk+-3.0)"}}
+	libfoo := &Package{Name: "libfoo"}
+
+	g := NewBuildGraph([]*Package{app, libfoo})
+	missing := g.Missing(app, map[string]bool{"glib2-devel": true})
+	if len(missing) != 1 || missing[0] != "libbar-devel" {
+		t.Fatalf("Wrong missing dependencies: %v", missing)
+	}
+	if missing := g.Missing(libfoo, nil); len(missing) != 0 {
+		t.Fatalf("Wrong missing dependencies for libfoo: %v", missing)
+	}
+}
+
+func TestEopkgNameFromFile(t *testing.T) {
+	names := map[string]string{
+		"/repo/nano-2.7.5-68-1-x86_64.eopkg":      "nano",
+		"libfoo-32bit-devel-1.0-2-1-x86_64.eopkg": "libfoo-32bit-devel",
+		"broken.eopkg": "broken",
+	}
+	for file, name := range names {
+		if got := EopkgNameFromFile(file); got != name {
+			t.Fatalf("Wrong name for %s: %s", file, got)
+		}
+	}
+}
@@ -216,6 +216,13 @@ func (e *EopkgManager) InstallComponent(comp string) error {
 	return err
 }
 
+// Reinstall will install the named packages again inside the chroot
+func (e *EopkgManager) Reinstall(pkgs []string) error {
+	err := ChrootExec(e.notif, e.root, eopkgCommand(fmt.Sprintf("eopkg install --reinstall -y %s", strings.Join(pkgs, " "))))
+	e.notif.SetActivePID(0)
+	return err
+}
+
 // EnsureEopkgLayout will enforce changes to the filesystem to make sure that
 // it works as expected.
 func EnsureEopkgLayout(root string) error {
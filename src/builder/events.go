@@ -0,0 +1,117 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"sync"
+	"time"
+)
+
+// EventType identifies the point in the build lifecycle an Event refers to
+type EventType string
+
+const (
+	// EventOverlayMounted is emitted once the overlayfs root has been brought up
+	EventOverlayMounted EventType = "overlay-mounted"
+
+	// EventSourcesFetched is emitted once all sources are available locally
+	EventSourcesFetched EventType = "sources-fetched"
+
+	// EventReposConfigured is emitted when the profile repos have been applied
+	EventReposConfigured EventType = "repos-configured"
+
+	// EventBaseUpgraded is emitted after the root has been upgraded
+	EventBaseUpgraded EventType = "base-upgraded"
+
+	// EventComponentsInstalled is emitted once system.devel has been installed
+	EventComponentsInstalled EventType = "components-installed"
+
+	// EventDepsInstalled is emitted once the build dependencies are installed
+	EventDepsInstalled EventType = "deps-installed"
+
+	// EventBuildStarted is emitted immediately before the package build begins
+	EventBuildStarted EventType = "build-started"
+
+	// EventBuildFinished is emitted when the package build completes successfully
+	EventBuildFinished EventType = "build-finished"
+
+	// EventArtifactsCollected is emitted once the build artifacts have been
+	// copied out of the build root.
+	EventArtifactsCollected EventType = "artifacts-collected"
+
+	// EventBuildFailed is emitted when the build could not complete
+	EventBuildFailed EventType = "build-failed"
+)
+
+// An Event is a single notification in the lifecycle of a build, sent to
+// every EventSubscriber registered with the Manager.
+type Event struct {
+	Type    EventType `json:"type"`             // What happened
+	Time    time.Time `json:"time"`             // When it happened
+	Profile string    `json:"profile"`          // Profile used for the build
+	Package string    `json:"package"`          // Name of the package
+	Version string    `json:"version"`          // Version of the package
+	Release int       `json:"release"`          // Release of the package
+	Commit  string    `json:"commit,omitempty"` // Commit of git builds
+	Error   string    `json:"error,omitempty"`  // Error string for failure events
+}
+
+// An EventSubscriber is notified of each Event emitted by the Manager.
+//
+// HandleEvent is called synchronously from the build, so implementations
+// should avoid blocking for any length of time.
+type EventSubscriber interface {
+	HandleEvent(e *Event)
+}
+
+// EventNotifier is implemented by the Manager to allow the build process to
+// report progress as well as the active PID.
+type EventNotifier interface {
+	PidNotifier
+	EmitEvent(t EventType)
+}
+
+// A JSONEventWriter will write each Event it receives to the underlying
+// writer as newline delimited JSON.
+type JSONEventWriter struct {
+	enc    *json.Encoder
+	lock   *sync.Mutex
+	failed bool // Whether a write has failed, so it's only logged once
+}
+
+// NewJSONEventWriter will return a new JSONEventWriter for the given writer
+func NewJSONEventWriter(w io.Writer) *JSONEventWriter {
+	return &JSONEventWriter{
+		enc:  json.NewEncoder(w),
+		lock: new(sync.Mutex),
+	}
+}
+
+// HandleEvent will encode the event as a single line of JSON
+func (j *JSONEventWriter) HandleEvent(e *Event) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if err := j.enc.Encode(e); err != nil && !j.failed {
+		j.failed = true
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to write build events")
+	}
+}
@@ -0,0 +1,55 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestJSONEventWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewJSONEventWriter(&buf)
+
+	w.HandleEvent(&Event{Type: EventOverlayMounted, Package: "nano", Release: 3})
+	w.HandleEvent(&Event{Type: EventBuildFailed, Package: "nano", Error: "nope"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines of events, got %d", len(lines))
+	}
+
+	var e Event
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if e.Type != EventOverlayMounted || e.Package != "nano" || e.Release != 3 {
+		t.Fatalf("Wrong event decoded: %v", e)
+	}
+	if strings.Contains(lines[0], "error") {
+		t.Fatalf("Successful event should not contain an error: %s", lines[0])
+	}
+
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if e.Type != EventBuildFailed || e.Error != "nope" {
+		t.Fatalf("Wrong failure event decoded: %v", e)
+	}
+}
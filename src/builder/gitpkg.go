@@ -0,0 +1,225 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"builder/source"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/libgit2/git2go"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// GitPackagePrefix marks a build argument as a git repository rather
+	// than a local file, i.e. git+https://github.com/solus-packages/nano.git#v2.7.1
+	GitPackagePrefix = "git+"
+
+	// GitPackageDir is where the repositories of git builds are cloned
+	GitPackageDir = "/var/lib/solbuild/packages/git"
+)
+
+var (
+	// ErrGitPackageRef is returned when a git build does not name a ref
+	ErrGitPackageRef = errors.New("A git build must specify a ref, i.e. git+<url>#<ref>")
+
+	// GitPackageLockInterval is how often we check whether another build
+	// has released the repository we're waiting on
+	GitPackageLockInterval = time.Second
+
+	// gitRemoteSchemes are the schemes of repositories on a remote host
+	gitRemoteSchemes = map[string]bool{
+		"https": true,
+		"ssh":   true,
+		"git":   true,
+	}
+)
+
+// A GitPackage is a package spec found within a git repository, at the given
+// ref and within the given subdirectory.
+type GitPackage struct {
+	URI    string // URI of the repository, without the git+ prefix
+	Ref    string // Branch, tag or commit to build
+	Subdir string // Subdirectory containing the spec, if any
+
+	lock *os.File // Held while the work tree of the repository is in use
+}
+
+// IsGitPackage will determine whether the build argument names a git
+// repository rather than a local file.
+func IsGitPackage(arg string) bool {
+	return strings.HasPrefix(arg, GitPackagePrefix)
+}
+
+// ParseGitPackage will parse a build argument in the form of
+// git+<url>#<ref>[:subdir]
+func ParseGitPackage(arg string) (*GitPackage, error) {
+	if !IsGitPackage(arg) {
+		return nil, fmt.Errorf("Not a git build: %s", arg)
+	}
+	uri := strings.TrimPrefix(arg, GitPackagePrefix)
+	idx := strings.LastIndex(uri, "#")
+	if idx < 0 || idx == len(uri)-1 {
+		return nil, ErrGitPackageRef
+	}
+	g := &GitPackage{URI: uri[:idx], Ref: uri[idx+1:]}
+	if idx := strings.Index(g.Ref, ":"); idx >= 0 {
+		g.Subdir = filepath.Clean(g.Ref[idx+1:])
+		g.Ref = g.Ref[:idx]
+		if filepath.IsAbs(g.Subdir) || strings.HasPrefix(g.Subdir, "..") {
+			return nil, fmt.Errorf("Invalid subdirectory in git build: %s", g.Subdir)
+		}
+	}
+	if g.URI == "" || g.Ref == "" {
+		return nil, ErrGitPackageRef
+	}
+	return g, nil
+}
+
+// IsRemote will determine whether the repository lives on a remote host,
+// using one of the https, ssh or git schemes, rather than on the local
+// filesystem.
+func (g *GitPackage) IsRemote() bool {
+	u, err := url.Parse(g.URI)
+	return err == nil && gitRemoteSchemes[u.Scheme] && u.Host != ""
+}
+
+// source returns the git source used to clone the repository, which is kept
+// apart from the sources used by builds.
+func (g *GitPackage) source() (*source.GitSource, error) {
+	src, err := source.NewGit(g.URI, g.Ref)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(source.GitSourceDir, src.ClonePath)
+	if err != nil {
+		return nil, err
+	}
+	src.ClonePath = filepath.Join(GitPackageDir, rel)
+	return src, nil
+}
+
+// Lock will take an exclusive lock on the repository, waiting for any other
+// build of it to release it first. Every build of the repository shares the
+// same work tree, so the lock must be held from the Fetch until the build is
+// complete, and then released with Unlock.
+func (g *GitPackage) Lock(ctx context.Context) error {
+	src, err := g.source()
+	if err != nil {
+		return err
+	}
+	path := src.ClonePath + ".lock"
+	if err := os.MkdirAll(filepath.Dir(path), 00755); err != nil {
+		return err
+	}
+	fi, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 00644)
+	if err != nil {
+		return err
+	}
+
+	waiting := false
+	for {
+		err := syscall.Flock(int(fi.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != syscall.EWOULDBLOCK {
+			fi.Close()
+			return err
+		}
+		if !waiting {
+			log.WithFields(log.Fields{
+				"uri": g.URI,
+			}).Info("Waiting for another build of the repository to finish")
+			waiting = true
+		}
+		select {
+		case <-time.After(GitPackageLockInterval):
+		case <-ctx.Done():
+			fi.Close()
+			return ctx.Err()
+		}
+	}
+	g.lock = fi
+	return nil
+}
+
+// Unlock will release the lock taken on the repository by Lock
+func (g *GitPackage) Unlock() {
+	if g.lock == nil {
+		return
+	}
+	g.lock.Close()
+	g.lock = nil
+}
+
+// Fetch will clone or update the repository, check out the ref and return
+// the path to the spec found there, along with the commit that was checked
+// out. The repository should be locked with Lock first.
+func (g *GitPackage) Fetch(ctx context.Context) (string, string, error) {
+	src, err := g.source()
+	if err != nil {
+		return "", "", err
+	}
+
+	log.WithFields(log.Fields{
+		"uri": g.URI,
+		"ref": g.Ref,
+	}).Info("Fetching package repository")
+
+	if err := src.Fetch(ctx); err != nil {
+		return "", "", err
+	}
+
+	repo, err := git.OpenRepository(src.ClonePath)
+	if err != nil {
+		return "", "", err
+	}
+	commit, err := src.GetHead(repo)
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := filepath.Join(src.ClonePath, g.Subdir)
+	for _, name := range []string{"package.yml", "pspec.xml"} {
+		path := filepath.Join(dir, name)
+		if PathExists(path) {
+			log.WithFields(log.Fields{
+				"path":   path,
+				"commit": commit,
+			}).Debug("Found package in repository")
+			return path, commit, nil
+		}
+	}
+	return "", "", fmt.Errorf("No package.yml or pspec.xml found in %s", g)
+}
+
+// String returns the git+ form of the package
+func (g *GitPackage) String() string {
+	s := fmt.Sprintf("%s%s#%s", GitPackagePrefix, g.URI, g.Ref)
+	if g.Subdir != "" {
+		s += ":" + g.Subdir
+	}
+	return s
+}
@@ -0,0 +1,77 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+func TestParseGitPackage(t *testing.T) {
+	good := map[string]GitPackage{
+		"git+https://github.com/solus-packages/nano.git#v2.7.1": {
+			URI: "https://github.com/solus-packages/nano.git",
+			Ref: "v2.7.1",
+		},
+		"git+ssh://git@example.com:2222/packages.git#3f1c2e9:n/nano": {
+			URI:    "ssh://git@example.com:2222/packages.git",
+			Ref:    "3f1c2e9",
+			Subdir: "n/nano",
+		},
+	}
+	for arg, expected := range good {
+		g, err := ParseGitPackage(arg)
+		if err != nil {
+			t.Fatalf("Failed to parse valid git build '%s': %v", arg, err)
+		}
+		if *g != expected {
+			t.Fatalf("Wrong git build for '%s': %+v vs expected %+v", arg, *g, expected)
+		}
+		if g.String() != arg {
+			t.Fatalf("git build did not round trip: '%s' vs '%s'", g.String(), arg)
+		}
+	}
+
+	bad := []string{
+		"https://github.com/solus-packages/nano.git#v2.7.1",
+		"git+https://github.com/solus-packages/nano.git",
+		"git+https://github.com/solus-packages/nano.git#",
+		"git+https://github.com/solus-packages/nano.git#master:../../etc",
+	}
+	for _, arg := range bad {
+		if _, err := ParseGitPackage(arg); err == nil {
+			t.Fatalf("Should not be able to parse invalid git build '%s'", arg)
+		}
+	}
+}
+
+func TestGitPackageIsRemote(t *testing.T) {
+	remote := map[string]bool{
+		"https://github.com/solus-packages/nano.git": true,
+		"ssh://git@example.com:2222/packages.git":    true,
+		"git://example.com/packages.git":             true,
+		"file:///root/packages.git":                  false,
+		"/root/packages.git":                         false,
+		"http://example.com/packages.git":            false,
+		"ssh:///root/packages.git":                   false,
+	}
+	for uri, expected := range remote {
+		g := &GitPackage{URI: uri, Ref: "master"}
+		if g.IsRemote() != expected {
+			t.Fatalf("Wrong remote state for '%s': expected %v", uri, expected)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/solus-project/libosdev/disk"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// ImageRequiredComponent must be fully installed in every image
+	ImageRequiredComponent = "system.devel"
+
+	// EopkgPackageDBDir holds a directory for each installed package, relative
+	// to the root.
+	EopkgPackageDBDir = "var/lib/eopkg/package"
+
+	// EopkgIndexDir holds the index of each repo, relative to the root
+	EopkgIndexDir = "var/lib/eopkg/index"
+)
+
+var (
+	// ErrImageNoBuildUser is returned when the image has no build user
+	ErrImageNoBuildUser = errors.New("The build user is missing from the image")
+
+	// ErrImageBroken is returned when eopkg finds broken packages in the image
+	ErrImageBroken = errors.New("eopkg found broken packages in the image")
+
+	// ErrImageNotInstalled is returned when checking an image that isn't installed
+	ErrImageNotInstalled = errors.New("Image is not installed")
+
+	// ErrImageFilesystem is returned when fsck cannot repair the image
+	ErrImageFilesystem = errors.New("The filesystem of the image could not be repaired")
+)
+
+// An eopkgIndex is the subset of a repo index needed to resolve components
+type eopkgIndex struct {
+	Packages []struct {
+		Name   string `xml:"Name"`
+		PartOf string `xml:"PartOf"`
+	} `xml:"Package"`
+}
+
+// An eopkgMetadata is the subset of installed package metadata that is
+// needed to check the entry is intact.
+type eopkgMetadata struct {
+	Name string `xml:"Package>Name"`
+}
+
+// An eopkgFiles is the list of files installed by a package
+type eopkgFiles struct {
+	Files []struct {
+		Path string `xml:"Path"`
+	} `xml:"File"`
+}
+
+// packageEntries returns the entries of the installed package database of
+// the root, keyed by package name.
+func packageEntries(root string) (map[string]string, error) {
+	dir := filepath.Join(root, EopkgPackageDBDir)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string)
+	for _, e := range entries {
+		// Entries are named $name-$version-$release
+		fields := strings.Split(e.Name(), "-")
+		if !e.IsDir() || len(fields) < 3 {
+			continue
+		}
+		ret[strings.Join(fields[:len(fields)-2], "-")] = filepath.Join(dir, e.Name())
+	}
+	return ret, nil
+}
+
+// InstalledPackages returns the names of all packages installed in the root
+func InstalledPackages(root string) ([]string, error) {
+	entries, err := packageEntries(root)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// readXML will decode the XML file at path into v
+func readXML(path string, v interface{}) error {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return xml.Unmarshal(blob, v)
+}
+
+// BrokenPackages returns the names of all installed packages in the root
+// whose database entry is damaged, i.e. after a power loss.
+func BrokenPackages(root string) ([]string, error) {
+	entries, err := packageEntries(root)
+	if err != nil {
+		return nil, err
+	}
+	var broken []string
+	for name, dir := range entries {
+		var meta eopkgMetadata
+		var files eopkgFiles
+		if err := readXML(filepath.Join(dir, "metadata.xml"), &meta); err != nil || meta.Name != name {
+			broken = append(broken, name)
+			continue
+		}
+		if err := readXML(filepath.Join(dir, "files.xml"), &files); err != nil {
+			broken = append(broken, name)
+		}
+	}
+	sort.Strings(broken)
+	return broken, nil
+}
+
+// ComponentPackages returns the names of all packages belonging to the
+// component in the repo indexes of the root.
+func ComponentPackages(root, component string) ([]string, error) {
+	indexes, err := filepath.Glob(filepath.Join(root, EopkgIndexDir, "*", "eopkg-index.xml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) < 1 {
+		return nil, fmt.Errorf("No repo index found")
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, path := range indexes {
+		var index eopkgIndex
+		if err := readXML(path, &index); err != nil {
+			return nil, fmt.Errorf("Invalid repo index %s: %v", path, err)
+		}
+		for _, p := range index.Packages {
+			if p.PartOf == component && !seen[p.Name] {
+				seen[p.Name] = true
+				names = append(names, p.Name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// MissingComponentPackages returns the packages of the component that are
+// not installed in the root.
+func MissingComponentPackages(root, component string) ([]string, error) {
+	want, err := ComponentPackages(root, component)
+	if err != nil {
+		return nil, err
+	}
+	have, err := InstalledPackages(root)
+	if err != nil {
+		return nil, err
+	}
+	installed := make(map[string]bool)
+	for _, name := range have {
+		installed[name] = true
+	}
+	var missing []string
+	for _, name := range want {
+		if !installed[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing, nil
+}
+
+// CheckBuildUser will ensure the build user and group exist in the root
+// with the expected IDs.
+func CheckBuildUser(root string) error {
+	pwd, err := NewPasswd(filepath.Join(root, "etc"))
+	if err != nil {
+		return err
+	}
+	user, ok := pwd.Users[BuildUser]
+	if !ok {
+		return ErrImageNoBuildUser
+	}
+	if user.UID != BuildUserID || user.GID != BuildUserGID {
+		return fmt.Errorf("The build user has IDs %d:%d rather than %d:%d", user.UID, user.GID, BuildUserID, BuildUserGID)
+	}
+	if group, ok := pwd.Groups[BuildUser]; !ok || group.ID != BuildUserGID {
+		return fmt.Errorf("The build group is missing or does not have ID %d", BuildUserGID)
+	}
+	return nil
+}
+
+// captureNotifier collects the output of the processes it is notified about
+type captureNotifier struct {
+	PidNotifier
+	buf bytes.Buffer
+}
+
+// GetOutput sends all output to the buffer
+func (c *captureNotifier) GetOutput() (io.Writer, io.Writer) {
+	return &c.buf, &c.buf
+}
+
+// Context is that of the wrapped notifier
+func (c *captureNotifier) Context() context.Context {
+	return getContext(c.PidNotifier)
+}
+
+// checkPackages will have eopkg verify the files of every installed package
+func checkPackages(notif PidNotifier, root string) error {
+	capture := &captureNotifier{PidNotifier: notif}
+	err := ChrootExec(capture, root, "eopkg check -N")
+	notif.SetActivePID(0)
+	if err != nil {
+		os.Stderr.Write(capture.buf.Bytes())
+		return err
+	}
+	if bytes.Contains(capture.buf.Bytes(), []byte("Broken")) {
+		os.Stderr.Write(capture.buf.Bytes())
+		return ErrImageBroken
+	}
+	return nil
+}
+
+// ValidateRoot will ensure that the image mounted at root is usable for
+// builds: the build user must exist, the ImageRequiredComponent must be fully
+// installed and eopkg must not find any broken packages.
+func ValidateRoot(notif PidNotifier, root string) error {
+	if err := CheckBuildUser(root); err != nil {
+		return err
+	}
+	missing, err := MissingComponentPackages(root, ImageRequiredComponent)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Packages of %s are not installed: %s", ImageRequiredComponent, strings.Join(missing, ", "))
+	}
+	return checkPackages(notif, root)
+}
+
+// An ImageHealth is the outcome of checking an image
+type ImageHealth struct {
+	FilesystemErrors bool      // fsck found errors, so the contents weren't checked
+	BrokenPackages   []string  // Installed packages with a damaged database entry
+	BuildUser        error     // Problem with the build user, if any
+	Packages         int       // Number of installed packages
+	Updated          time.Time // When the image was last updated, as recorded in its metadata
+}
+
+// IsHealthy determines whether no problems were found
+func (h *ImageHealth) IsHealthy() bool {
+	return !h.FilesystemErrors && len(h.BrokenPackages) == 0 && h.BuildUser == nil
+}
+
+// fsckImage will check the filesystem of the image file, repairing it if
+// requested, and return whether the filesystem is now clean.
+func fsckImage(notif PidNotifier, path string, repair bool) (bool, error) {
+	mode := "-n"
+	if repair {
+		mode = "-y"
+	}
+	err := hostExec(notif, "e2fsck", "-f", mode, path)
+	if err == nil {
+		return true, nil
+	}
+	exit, ok := err.(*exec.ExitError)
+	if !ok {
+		return false, err
+	}
+	status, ok := exit.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false, err
+	}
+	// 1 and 2 mean errors were corrected, 4 that errors remain
+	switch status.ExitStatus() {
+	case 1, 2:
+		return true, nil
+	case 4:
+		return false, nil
+	}
+	return false, err
+}
+
+// Check will verify the filesystem of the image, then mount it read-only to
+// verify the package database and the build user.
+func (b *BackingImage) Check(notif PidNotifier) (*ImageHealth, error) {
+	if !PathExists(b.ImagePath) {
+		return nil, ErrImageNotInstalled
+	}
+	meta, err := b.ReadMetadata()
+	if err != nil {
+		return nil, err
+	}
+	h := &ImageHealth{Updated: meta.Updated}
+
+	log.WithFields(log.Fields{
+		"image": b.ImagePath,
+	}).Debug("Checking image filesystem")
+	clean, err := fsckImage(notif, b.ImagePath, false)
+	if err != nil {
+		return nil, err
+	}
+	// The contents can't be trusted until the filesystem is repaired
+	if h.FilesystemErrors = !clean; h.FilesystemErrors {
+		return h, nil
+	}
+
+	mountMan := disk.GetMountManager()
+	if err := os.MkdirAll(b.RootDir, 00755); err != nil {
+		return nil, err
+	}
+	if err := mountMan.Mount(b.ImagePath, b.RootDir, "auto", "loop", "ro"); err != nil {
+		log.WithFields(log.Fields{
+			"image": b.ImagePath,
+			"error": err,
+		}).Error("Failed to mount image")
+		return nil, err
+	}
+	defer mountMan.Unmount(b.RootDir)
+
+	installed, err := InstalledPackages(b.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	h.Packages = len(installed)
+	if h.BrokenPackages, err = BrokenPackages(b.RootDir); err != nil {
+		return nil, err
+	}
+	h.BuildUser = CheckBuildUser(b.RootDir)
+	return h, nil
+}
+
+// resetBuildUser will remove any build user and group unless both match the
+// expected IDs, so that AddBuildUser adds them again.
+func resetBuildUser(root string) error {
+	err := CheckBuildUser(root)
+	if err == nil {
+		return nil
+	}
+	log.WithFields(log.Fields{
+		"error": err,
+	}).Info("Replacing build user")
+	return RemoveEntries(filepath.Join(root, "etc"), BuildUser)
+}
+
+// Repair will attempt to fix the problems found by Check. The repair is made
+// to a staging copy of the image, as with Update: the filesystem of the copy
+// is repaired, then any broken packages are reinstalled and the build user
+// replaced, so the image in use by builds is never modified.
+func (b *BackingImage) Repair(notif PidNotifier, pkgManager *EopkgManager, h *ImageHealth) error {
+	fsck := func(staging string) error {
+		if !h.FilesystemErrors {
+			return nil
+		}
+		log.WithFields(log.Fields{
+			"image": staging,
+		}).Info("Repairing image filesystem")
+		clean, err := fsckImage(notif, staging, true)
+		if err != nil {
+			return err
+		}
+		if !clean {
+			return ErrImageFilesystem
+		}
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"image": b.Name,
+	}).Info("Repairing image")
+	return b.modifyStaged(notif, pkgManager, fsck, func() error {
+		// Contents couldn't be checked before the filesystem was repaired
+		broken, err := BrokenPackages(b.RootDir)
+		if err != nil {
+			return err
+		}
+		if err := resetBuildUser(b.RootDir); err != nil {
+			return err
+		}
+		if len(broken) == 0 {
+			return nil
+		}
+		log.WithFields(log.Fields{
+			"image":    b.Name,
+			"packages": broken,
+		}).Info("Reinstalling broken packages")
+		if err := pkgManager.Init(); err != nil {
+			return err
+		}
+		if err := pkgManager.StartDBUS(); err != nil {
+			return err
+		}
+		if err := pkgManager.Reinstall(broken); err != nil {
+			return err
+		}
+		return pkgManager.StopDBUS()
+	})
+}
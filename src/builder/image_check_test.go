@@ -0,0 +1,97 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testIndex = `<PISI>
+    <Distribution><SourceName>Solus</SourceName></Distribution>
+    <Package><Name>gcc</Name><PartOf>system.devel</PartOf></Package>
+    <Package><Name>make</Name><PartOf>system.devel</PartOf></Package>
+    <Package><Name>libstdc++-devel</Name><PartOf>system.devel</PartOf></Package>
+    <Package><Name>nano</Name><PartOf>system.utils</PartOf></Package>
+</PISI>`
+
+func TestMissingComponentPackages(t *testing.T) {
+	root, err := ioutil.TempDir("", "solbuild-check")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, pkg := range []string{"gcc-7.2.0-45", "libstdc++-devel-7.2.0-45", "nano-2.9.1-80"} {
+		if err := os.MkdirAll(filepath.Join(root, EopkgPackageDBDir, pkg), 00755); err != nil {
+			t.Fatalf("Failed to create package entry: %v", err)
+		}
+	}
+	// libstdc++-devel is left without metadata, as after a power loss
+	for name, pkg := range map[string]string{"gcc": "gcc-7.2.0-45", "nano": "nano-2.9.1-80"} {
+		dir := filepath.Join(root, EopkgPackageDBDir, pkg)
+		meta := "<PISI><Package><Name>" + name + "</Name></Package></PISI>"
+		if err := ioutil.WriteFile(filepath.Join(dir, "metadata.xml"), []byte(meta), 00644); err != nil {
+			t.Fatalf("Failed to write metadata: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "files.xml"), []byte("<Files></Files>"), 00644); err != nil {
+			t.Fatalf("Failed to write files: %v", err)
+		}
+	}
+	indexDir := filepath.Join(root, EopkgIndexDir, "Solus")
+	if err := os.MkdirAll(indexDir, 00755); err != nil {
+		t.Fatalf("Failed to create index directory: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(indexDir, "eopkg-index.xml"), []byte(testIndex), 00644); err != nil {
+		t.Fatalf("Failed to write index: %v", err)
+	}
+
+	installed, err := InstalledPackages(root)
+	if err != nil {
+		t.Fatalf("Failed to list installed packages: %v", err)
+	}
+	if !reflect.DeepEqual(installed, []string{"gcc", "libstdc++-devel", "nano"}) {
+		t.Fatalf("Wrong installed packages: %v", installed)
+	}
+
+	pkgs, err := ListInstalledPackages(root)
+	if err != nil {
+		t.Fatalf("Failed to list installed packages: %v", err)
+	}
+	if len(pkgs) != 3 || *pkgs[1] != (InstalledPackage{Name: "libstdc++-devel", Version: "7.2.0", Release: 45}) {
+		t.Fatalf("Wrong installed package details: %+v", pkgs[1])
+	}
+
+	missing, err := MissingComponentPackages(root, ImageRequiredComponent)
+	if err != nil {
+		t.Fatalf("Failed to find missing packages: %v", err)
+	}
+	if !reflect.DeepEqual(missing, []string{"make"}) {
+		t.Fatalf("Wrong missing packages: %v", missing)
+	}
+
+	broken, err := BrokenPackages(root)
+	if err != nil {
+		t.Fatalf("Failed to find broken packages: %v", err)
+	}
+	if !reflect.DeepEqual(broken, []string{"libstdc++-devel"}) {
+		t.Fatalf("Wrong broken packages: %v", broken)
+	}
+}
@@ -0,0 +1,237 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/solus-project/libosdev/disk"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// ImageRepoName is the name of the repo images are bootstrapped from
+	ImageRepoName = "Solus"
+
+	// DefaultImageSize is the size of the image file for new images. The file
+	// is sparse, so only the space actually used is taken on disk.
+	DefaultImageSize = "20G"
+)
+
+var (
+	// DefaultImageComponents are installed into new images unless told otherwise
+	DefaultImageComponents = []string{"system.base", "system.devel"}
+
+	// ErrImageExists is returned when creating an image that already exists
+	ErrImageExists = errors.New("An image of that name already exists")
+
+	// ErrLocalImage is returned when fetching an image that was created
+	// locally, and so cannot be downloaded
+	ErrLocalImage = errors.New("The image was created locally and cannot be downloaded")
+)
+
+// An ImageRecipe describes how to bootstrap a new backing image
+type ImageRecipe struct {
+	Name       string   // Name of the new image
+	Size       string   // Size of the image file, i.e. 20G
+	Repo       string   // URI of the eopkg index to install from
+	Components []string // Components to install
+	Packages   []string // Additional packages to install
+}
+
+// hostExec will run the command on the host, stopping it if the context of
+// the notifier is done.
+func hostExec(notif PidNotifier, name string, args ...string) error {
+	c := exec.Command(name, args...)
+	c.Stdout, c.Stderr = getOutput(notif)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	ctx := getContext(notif)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	notif.SetActivePID(c.Process.Pid)
+	defer notif.SetActivePID(0)
+	return waitContext(ctx, c)
+}
+
+// createImageFile will allocate a sparse ext4 filesystem image
+func createImageFile(notif PidNotifier, path, size string) error {
+	bytes, err := ParseMemorySize(size)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 00644)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(bytes)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return hostExec(notif, "mkfs.ext4", "-F", "-q", path)
+}
+
+// installPackages will install the recipe into the root using the host
+// eopkg, and then configure the packages from within the root.
+func (r *ImageRecipe) installPackages(notif PidNotifier, root string, pkgManager *EopkgManager) error {
+	if err := hostExec(notif, "eopkg", "add-repo", "-D", root, ImageRepoName, r.Repo); err != nil {
+		return fmt.Errorf("Failed to add repo: %v", err)
+	}
+
+	args := []string{"install", "-y", "--ignore-comar", "-D", root}
+	if DisableColors {
+		args = append(args, "-N")
+	}
+	if len(r.Components) > 0 {
+		args = append(args, "-c", strings.Join(r.Components, ","))
+	}
+	args = append(args, r.Packages...)
+	if err := hostExec(notif, "eopkg", args...); err != nil {
+		return fmt.Errorf("Failed to install packages: %v", err)
+	}
+
+	if err := EnsureEopkgLayout(root); err != nil {
+		return err
+	}
+
+	// Package configuration must happen inside the root
+	if err := pkgManager.StartDBUS(); err != nil {
+		return err
+	}
+	if err := ChrootExec(notif, root, eopkgCommand("eopkg configure-pending")); err != nil {
+		return fmt.Errorf("Failed to configure packages: %v", err)
+	}
+	notif.SetActivePID(0)
+	return pkgManager.StopDBUS()
+}
+
+// Create will bootstrap a new image from the recipe. The image is only
+// stored at ImagePath once it is complete.
+func (b *BackingImage) Create(notif PidNotifier, pkgManager *EopkgManager, r *ImageRecipe) error {
+	if b.IsInstalled() {
+		return ErrImageExists
+	}
+	mountMan := disk.GetMountManager()
+	part := b.ImagePath + ImagePartialSuffix
+
+	log.WithFields(log.Fields{
+		"image": b.Name,
+		"size":  r.Size,
+	}).Info("Creating image file")
+	if err := os.MkdirAll(ImagesDir, 00755); err != nil {
+		return err
+	}
+	if err := createImageFile(notif, part, r.Size); err != nil {
+		os.Remove(part)
+		return err
+	}
+
+	ok := false
+	defer func() {
+		if !ok {
+			os.Remove(part)
+		}
+	}()
+
+	if err := os.MkdirAll(b.RootDir, 00755); err != nil {
+		return err
+	}
+	if err := mountMan.Mount(part, b.RootDir, "ext4", "loop"); err != nil {
+		log.WithFields(log.Fields{
+			"image": part,
+			"error": err,
+		}).Error("Failed to mount new image")
+		return err
+	}
+
+	// Share the package cache with the host
+	if err := pkgManager.Init(); err != nil {
+		return err
+	}
+
+	procPoint := filepath.Join(b.RootDir, "proc")
+	if err := os.MkdirAll(procPoint, 00755); err != nil {
+		return err
+	}
+	if err := mountMan.Mount("proc", procPoint, "proc", "nosuid", "noexec"); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"repo":       r.Repo,
+		"components": r.Components,
+		"packages":   r.Packages,
+	}).Info("Installing packages into image")
+	if err := r.installPackages(notif, b.RootDir, pkgManager); err != nil {
+		return err
+	}
+
+	if err := AddBuildUser(b.RootDir); err != nil {
+		return err
+	}
+
+	inspected := &ImageMetadata{}
+	if err := inspected.inspectRoot(b.RootDir); err != nil {
+		return err
+	}
+
+	// The loop device holds the file open, so it may be renamed while mounted
+	if err := os.Rename(part, b.ImagePath); err != nil {
+		return err
+	}
+	ok = true
+
+	log.WithFields(log.Fields{
+		"image": b.ImagePath,
+	}).Info("Image successfully created")
+	return b.recordInit(r.Repo, "", inspected)
+}
+
+// ImageConfigPath returns the path of the configuration file registering a
+// locally created image.
+func ImageConfigPath(name string) string {
+	return filepath.Join(ConfigPaths[0], fmt.Sprintf("image-%s%s", name, ConfigSuffix))
+}
+
+// RegisterLocalImage will declare the locally created image in the
+// configuration, so that profiles may use it.
+func RegisterLocalImage(name string) error {
+	if !IsValidImageName(name) {
+		return fmt.Errorf("Invalid image name '%s', only letters, digits, '_' and '-' may be used", name)
+	}
+	if err := os.MkdirAll(ConfigPaths[0], 00755); err != nil {
+		return err
+	}
+	config := fmt.Sprintf("# Created by solbuild image create\n[images.%s]\nlocal = true\n", name)
+	if err := ioutil.WriteFile(ImageConfigPath(name), []byte(config), 00644); err != nil {
+		return err
+	}
+	return RegisterImages(map[string]*ImageDefinition{
+		name: {Local: true},
+	})
+}
@@ -0,0 +1,292 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/cheggaaa/pb"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// ImageChecksumSuffix is appended to the URI of an image to find its
+	// published sha256sum
+	ImageChecksumSuffix = ".sha256"
+
+	// ImagePartialSuffix is appended to the path of an image while it is
+	// being downloaded
+	ImagePartialSuffix = ".part"
+)
+
+var (
+	// ImageFetchAttempts is how many times we'll try to download an image
+	ImageFetchAttempts = 5
+
+	// ImageFetchBackoff is how long we wait before the first retry, doubling
+	// for each retry after it up to ImageFetchMaxBackoff
+	ImageFetchBackoff = 2 * time.Second
+
+	// ImageFetchMaxBackoff is the longest we'll wait between retries
+	ImageFetchMaxBackoff = time.Minute
+
+	// ImageFetchStallTimeout is how long a download may go without receiving
+	// any data before it is abandoned and retried
+	ImageFetchStallTimeout = time.Minute
+
+	// ErrImageChecksum is returned when a downloaded image does not match
+	// its published checksum
+	ErrImageChecksum = errors.New("The image does not match its published checksum")
+
+	// ErrImageUnverified is returned when no checksum is known for an image
+	// that must be verified
+	ErrImageUnverified = errors.New("No checksum is published for the image, unable to verify it")
+)
+
+// imageClient is used for all image downloads. There is no overall timeout
+// as images are large, instead stalled downloads are caught by stallReader.
+var imageClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   30 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+// stallReader will cancel the download if no data arrives for the
+// ImageFetchStallTimeout.
+type stallReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.timer.Reset(ImageFetchStallTimeout)
+	}
+	return n, err
+}
+
+// ImageURIs returns the locations the image may be downloaded from, in the
+// order they're tried. Each mirror is a base URI in the same form as the
+// ImageBaseURI.
+func (b *BackingImage) ImageURIs(mirrors []string) []string {
+	uris := []string{b.ImageURI}
+	for _, m := range mirrors {
+		uris = append(uris, fmt.Sprintf("%s/%s", strings.TrimSuffix(m, "/"), path.Base(b.ImageURI)))
+	}
+	return uris
+}
+
+// Fetch will download the compressed image, trying the ImageURI and then
+// each of the mirrors in turn until it succeeds or runs out of attempts.
+// Interrupted downloads are resumed where they left off, and the image is
+// only stored at ImagePathXZ once it matches its checksum.
+func (b *BackingImage) Fetch(ctx context.Context, mirrors []string) error {
+	uris := b.ImageURIs(mirrors)
+	part := b.ImagePathXZ + ImagePartialSuffix
+	backoff := ImageFetchBackoff
+
+	var err error
+	for attempt := 0; attempt < ImageFetchAttempts; attempt++ {
+		uri := uris[attempt%len(uris)]
+		if attempt > 0 {
+			log.WithFields(log.Fields{
+				"uri":   uri,
+				"delay": backoff,
+			}).Info("Retrying image download")
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if backoff *= 2; backoff > ImageFetchMaxBackoff {
+				backoff = ImageFetchMaxBackoff
+			}
+		}
+
+		if err = b.fetchFrom(ctx, uri, part); err == nil {
+			return os.Rename(part, b.ImagePathXZ)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.WithFields(log.Fields{
+			"uri":   uri,
+			"error": err,
+		}).Warning("Failed to download image")
+	}
+	return err
+}
+
+// fetchFrom will download the image from the given URI to the partial file,
+// and verify it against the known checksum, or that published alongside it.
+// Unless the image allows it, nothing is downloaded if no checksum is known.
+func (b *BackingImage) fetchFrom(ctx context.Context, uri, part string) error {
+	sum := b.Checksum
+	if sum == "" {
+		var err error
+		if sum, err = fetchChecksum(ctx, uri+ImageChecksumSuffix); err != nil {
+			return err
+		}
+	}
+	if sum == "" && !b.AllowUnverified {
+		return ErrImageUnverified
+	}
+	if err := downloadResume(ctx, uri, part); err != nil {
+		return err
+	}
+	if sum == "" {
+		log.WithFields(log.Fields{
+			"uri": uri,
+		}).Warning("No checksum is published for the image, unable to verify it")
+		return nil
+	}
+
+	got, err := FileSha256sum(part)
+	if err != nil {
+		return err
+	}
+	if got != sum {
+		log.WithFields(log.Fields{
+			"expected": sum,
+			"got":      got,
+		}).Error("Image checksum mismatch")
+		// Start afresh on the next attempt
+		os.Remove(part)
+		return ErrImageChecksum
+	}
+	log.WithFields(log.Fields{
+		"sha256": sum,
+	}).Debug("Verified image checksum")
+	return nil
+}
+
+// fetchChecksum will return the sha256sum published at the URI, in the form
+// written by sha256sum(1). An empty string is returned if none is published.
+func fetchChecksum(ctx context.Context, uri string) (string, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := imageClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return "", nil
+	default:
+		return "", fmt.Errorf("Failed to fetch %s: %s", uri, resp.Status)
+	}
+
+	blob, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(blob))
+	if len(fields) < 1 || len(fields[0]) != 64 {
+		return "", fmt.Errorf("Invalid checksum published at %s", uri)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// downloadResume will download the URI into the given file, continuing from
+// the end of the file if the server supports it.
+func downloadResume(ctx context.Context, uri, path string) error {
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 00644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := imageClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		log.WithFields(log.Fields{
+			"uri":    uri,
+			"offset": offset,
+		}).Info("Resuming image download")
+	case http.StatusOK:
+		// No range support, or nothing to resume
+		if offset > 0 {
+			if err := out.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := out.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			offset = 0
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Already have all of it, the checksum will tell us if not
+		return nil
+	default:
+		return fmt.Errorf("Failed to fetch %s: %s", uri, resp.Status)
+	}
+
+	bar := pb.New64(offset + resp.ContentLength).SetUnits(pb.U_BYTES)
+	bar.Set64(offset)
+	bar.ShowSpeed = true
+	bar.Start()
+	defer bar.Finish()
+
+	timer := time.AfterFunc(ImageFetchStallTimeout, cancel)
+	defer timer.Stop()
+	body := &stallReader{r: bar.NewProxyReader(resp.Body), timer: timer}
+
+	if _, err := io.Copy(out, body); err != nil {
+		return err
+	}
+	return out.Sync()
+}
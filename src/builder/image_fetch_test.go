@@ -0,0 +1,139 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestImageFetchResume(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "solbuild-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	image := bytes.Repeat([]byte("solbuild"), 64*1024)
+	h := sha256.Sum256(image)
+	sum := hex.EncodeToString(h[:])
+
+	var ranges []string
+	var rangesLock sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ImageChecksumSuffix) {
+			w.Write([]byte(sum + "  main-x86_64.img.xz\n"))
+			return
+		}
+		rangesLock.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		rangesLock.Unlock()
+		http.ServeContent(w, r, "main-x86_64.img.xz", time.Now(), bytes.NewReader(image))
+	}))
+	defer srv.Close()
+
+	b := &BackingImage{
+		Name:        "main-x86_64",
+		ImagePathXZ: filepath.Join(tmp, "main-x86_64.img.xz"),
+		ImageURI:    srv.URL + "/main-x86_64.img.xz",
+	}
+
+	// Pretend an earlier download was cut off half way
+	half := len(image) / 2
+	ioutil.WriteFile(b.ImagePathXZ+ImagePartialSuffix, image[:half], 00644)
+
+	if err := b.Fetch(context.Background(), nil); err != nil {
+		t.Fatalf("Failed to fetch image: %v", err)
+	}
+	got, err := ioutil.ReadFile(b.ImagePathXZ)
+	if err != nil {
+		t.Fatalf("Image was not stored: %v", err)
+	}
+	if !bytes.Equal(got, image) {
+		t.Fatalf("Resumed image is corrupt")
+	}
+	rangesLock.Lock()
+	if len(ranges) != 1 || ranges[0] != fmt.Sprintf("bytes=%d-", half) {
+		t.Fatalf("Download was not resumed: %v", ranges)
+	}
+	rangesLock.Unlock()
+
+	// A corrupt partial download must be thrown away and fetched again
+	os.Remove(b.ImagePathXZ)
+	ioutil.WriteFile(b.ImagePathXZ+ImagePartialSuffix, []byte("garbage"), 00644)
+	defer func(d time.Duration) { ImageFetchBackoff = d }(ImageFetchBackoff)
+	ImageFetchBackoff = time.Millisecond
+	if err := b.Fetch(context.Background(), nil); err != nil {
+		t.Fatalf("Failed to fetch image after corruption: %v", err)
+	}
+	if got, _ = ioutil.ReadFile(b.ImagePathXZ); !bytes.Equal(got, image) {
+		t.Fatalf("Image is corrupt after retry")
+	}
+}
+
+func TestImageFetchUnverified(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "solbuild-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	image := []byte("solbuild")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ImageChecksumSuffix) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(image)
+	}))
+	defer srv.Close()
+
+	b := &BackingImage{
+		Name:        "main-x86_64",
+		ImagePathXZ: filepath.Join(tmp, "main-x86_64.img.xz"),
+		ImageURI:    srv.URL + "/main-x86_64.img.xz",
+	}
+
+	defer func(d time.Duration) { ImageFetchBackoff = d }(ImageFetchBackoff)
+	ImageFetchBackoff = time.Millisecond
+	if err := b.Fetch(context.Background(), nil); err != ErrImageUnverified {
+		t.Fatalf("Image without a checksum should not be fetched: %v", err)
+	}
+	if b.IsFetched() {
+		t.Fatalf("Unverified image should not be stored")
+	}
+
+	b.AllowUnverified = true
+	if err := b.Fetch(context.Background(), nil); err != nil {
+		t.Fatalf("Failed to fetch image allowed to be unverified: %v", err)
+	}
+	if got, _ := ioutil.ReadFile(b.ImagePathXZ); !bytes.Equal(got, image) {
+		t.Fatalf("Unverified image is corrupt")
+	}
+}
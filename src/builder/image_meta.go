@@ -0,0 +1,198 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageMetadataSuffix is appended to the image name to form the name of the
+// metadata file stored alongside it.
+const ImageMetadataSuffix = ".meta.json"
+
+// ImageMetadata is stored alongside each image to record its provenance, and
+// is embedded in build reports to trace the image a package was built with.
+type ImageMetadata struct {
+	Name        string      `json:"name"`
+	URI         string      `json:"uri,omitempty"`      // Where the image was fetched from, or the repo it was created from
+	Checksum    string      `json:"checksum,omitempty"` // sha256sum of the fetched image
+	Initialised time.Time   `json:"initialised"`        // When the image was fetched or created
+	Updated     time.Time   `json:"updated"`            // When the image was last created or updated
+	Updates     []time.Time `json:"updates,omitempty"`  // Time of each update
+
+	RepoRevisions map[string]string `json:"repo_revisions,omitempty"` // sha256sum of each repo index last upgraded against
+	PackagesHash  string            `json:"packages_hash,omitempty"`  // sha256sum of the installed package list
+}
+
+// repoRevisions returns the sha256sum of the index of each repo in the root
+func repoRevisions(root string) (map[string]string, error) {
+	indexes, err := filepath.Glob(filepath.Join(root, EopkgIndexDir, "*", "eopkg-index.xml"))
+	if err != nil {
+		return nil, err
+	}
+	revisions := make(map[string]string)
+	for _, path := range indexes {
+		sum, err := FileSha256sum(path)
+		if err != nil {
+			return nil, err
+		}
+		revisions[filepath.Base(filepath.Dir(path))] = sum
+	}
+	return revisions, nil
+}
+
+// PackagesHash returns the sha256sum of the name, version and release of
+// every package installed in the root, which changes whenever the set of
+// installed packages does.
+func PackagesHash(root string) (string, error) {
+	entries, err := packageEntries(root)
+	if err != nil {
+		return "", err
+	}
+	var lines []string
+	for _, dir := range entries {
+		lines = append(lines, filepath.Base(dir)+"\n")
+	}
+	sort.Strings(lines)
+	h := sha256.New()
+	for _, l := range lines {
+		h.Write([]byte(l))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// inspectRoot will record the repo revisions and installed packages of the
+// image mounted at root.
+func (meta *ImageMetadata) inspectRoot(root string) error {
+	var err error
+	if meta.RepoRevisions, err = repoRevisions(root); err != nil {
+		return err
+	}
+	meta.PackagesHash, err = PackagesHash(root)
+	return err
+}
+
+// MetadataPath returns the path of the metadata file of the image
+func (b *BackingImage) MetadataPath() string {
+	return filepath.Join(filepath.Dir(b.ImagePath), b.Name+ImageMetadataSuffix)
+}
+
+// ReadMetadata will return the metadata of the image. Images that were
+// fetched and never updated have no metadata file, so the modification time
+// of the image is used instead.
+func (b *BackingImage) ReadMetadata() (*ImageMetadata, error) {
+	blob, err := ioutil.ReadFile(b.MetadataPath())
+	if err == nil {
+		meta := &ImageMetadata{}
+		if err := json.Unmarshal(blob, meta); err != nil {
+			return nil, err
+		}
+		return meta, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	st, err := os.Stat(b.ImagePath)
+	if err != nil {
+		return nil, err
+	}
+	return &ImageMetadata{
+		Name:        b.Name,
+		Initialised: st.ModTime().UTC(),
+		Updated:     st.ModTime().UTC(),
+	}, nil
+}
+
+// writeImageMetadata will atomically store the metadata at the given path
+func writeImageMetadata(path string, meta *ImageMetadata) error {
+	blob, err := json.MarshalIndent(meta, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ImagePartialSuffix
+	if err := ioutil.WriteFile(tmp, append(blob, '\n'), 00644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// WriteMetadata will store the metadata alongside the image
+func (b *BackingImage) WriteMetadata(meta *ImageMetadata) error {
+	return writeImageMetadata(b.MetadataPath(), meta)
+}
+
+// recordInit will write the metadata of an image that was just fetched or
+// created from the given URI.
+func (b *BackingImage) recordInit(uri, checksum string, inspected *ImageMetadata) error {
+	now := time.Now().UTC()
+	meta := &ImageMetadata{
+		Name:        b.Name,
+		URI:         uri,
+		Checksum:    checksum,
+		Initialised: now,
+		Updated:     now,
+	}
+	if inspected != nil {
+		meta.RepoRevisions = inspected.RepoRevisions
+		meta.PackagesHash = inspected.PackagesHash
+	}
+	return b.WriteMetadata(meta)
+}
+
+// recordUpdate will record that the image was updated just now, along with
+// the inspected repo revisions and packages of the updated image.
+func (b *BackingImage) recordUpdate(inspected *ImageMetadata) error {
+	meta, err := b.ReadMetadata()
+	if err != nil {
+		meta = &ImageMetadata{Name: b.Name}
+	}
+	meta.Updated = time.Now().UTC()
+	meta.Updates = append(meta.Updates, meta.Updated)
+	meta.RepoRevisions = inspected.RepoRevisions
+	meta.PackagesHash = inspected.PackagesHash
+	return b.WriteMetadata(meta)
+}
+
+// Age returns how long it has been since the image was last updated
+func (b *BackingImage) Age() (time.Duration, error) {
+	meta, err := b.ReadMetadata()
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(meta.Updated), nil
+}
+
+// ParseAge will parse a duration as with time.ParseDuration, additionally
+// permitting a number of days such as "7d".
+func ParseAge(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err == nil {
+			return time.Duration(days * float64(24*time.Hour)), nil
+		}
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,82 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := map[string]time.Duration{
+		"7d":   7 * 24 * time.Hour,
+		"1.5d": 36 * time.Hour,
+		"72h":  72 * time.Hour,
+	}
+	for s, want := range tests {
+		got, err := ParseAge(s)
+		if err != nil {
+			t.Fatalf("Failed to parse age '%s': %v", s, err)
+		}
+		if got != want {
+			t.Fatalf("Wrong age for '%s': %v", s, got)
+		}
+	}
+	if _, err := ParseAge("d"); err == nil {
+		t.Fatalf("Should not parse an age without a number")
+	}
+}
+
+func TestImageMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-meta")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &BackingImage{Name: "test", ImagePath: filepath.Join(dir, "test.img")}
+	if err := ioutil.WriteFile(b.ImagePath, nil, 00644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(b.ImagePath, old, old); err != nil {
+		t.Fatalf("Failed to set image time: %v", err)
+	}
+
+	// Fetched images have no metadata
+	if age, err := b.Age(); err != nil || age < 47*time.Hour {
+		t.Fatalf("Age should be taken from the image, got: %v (%v)", age, err)
+	}
+
+	inspected := &ImageMetadata{PackagesHash: "abc"}
+	if err := b.recordUpdate(inspected); err != nil {
+		t.Fatalf("Failed to write metadata: %v", err)
+	}
+	if age, err := b.Age(); err != nil || age > time.Minute {
+		t.Fatalf("Age should be taken from the metadata, got: %v (%v)", age, err)
+	}
+	meta, err := b.ReadMetadata()
+	if err != nil {
+		t.Fatalf("Failed to read metadata: %v", err)
+	}
+	if meta.Initialised.After(old.Add(time.Second)) || len(meta.Updates) != 1 || meta.PackagesHash != "abc" {
+		t.Fatalf("Update should be recorded against the existing image: %+v", meta)
+	}
+}
@@ -0,0 +1,197 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// imageCompressors maps each supported image compression to the tool used
+// to decompress it, and the suffix the compressed image is stored with.
+var imageCompressors = map[string]struct {
+	tool   string
+	suffix string
+}{
+	"xz":   {"xz", ".xz"},
+	"gzip": {"gzip", ".gz"},
+	"zstd": {"zstd", ".zst"},
+	"none": {"", ""},
+}
+
+// An ImageDefinition describes where a backing image comes from. Images are
+// declared in the solbuild configuration as [images.$name] tables, alongside
+// the images published by Solus.
+type ImageDefinition struct {
+	URI         string `toml:"uri"`         // Where to download the image from
+	Checksum    string `toml:"checksum"`    // sha256sum of the download, if known
+	Compression string `toml:"compression"` // xz, gzip, zstd or none
+	Local       bool   `toml:"local"`       // Created with image create, has no uri
+
+	AllowUnverified bool `toml:"allow_unverified"` // Use the image even if no checksum is known
+}
+
+// Validate will ensure the definition is usable
+func (d *ImageDefinition) Validate() error {
+	if d.URI == "" && !d.Local {
+		return fmt.Errorf("No uri set")
+	}
+	if _, ok := imageCompressors[d.Compression]; !ok {
+		return fmt.Errorf("Unknown compression '%s', expected xz, gzip, zstd or none", d.Compression)
+	}
+	if d.Checksum != "" && len(d.Checksum) != 64 {
+		return fmt.Errorf("Invalid sha256 checksum '%s'", d.Checksum)
+	}
+	return nil
+}
+
+// Suffix returns the suffix of the downloaded image
+func (d *ImageDefinition) Suffix() string {
+	return ImageSuffix + imageCompressors[d.Compression].suffix
+}
+
+// solusImage returns the definition of an image published by Solus
+func solusImage(name string) *ImageDefinition {
+	return &ImageDefinition{
+		URI:         fmt.Sprintf("%s/%s%s", ImageBaseURI, name, ImageCompressedSuffix),
+		Compression: "xz",
+	}
+}
+
+// imageNameRegex matches the names an image may have. Names are used as
+// file names and as keys in the configuration, so they're kept simple.
+var imageNameRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// IsValidImageName will determine whether the name may be given to an image
+func IsValidImageName(name string) bool {
+	return imageNameRegex.MatchString(name)
+}
+
+var (
+	// images is the registry of all known images
+	images = map[string]*ImageDefinition{
+		"main-x86_64":     solusImage("main-x86_64"),
+		"unstable-x86_64": solusImage("unstable-x86_64"),
+	}
+	imagesLock sync.RWMutex
+)
+
+// RegisterImages will add the images declared in the configuration to the
+// registry, replacing any existing image of the same name.
+func RegisterImages(defs map[string]*ImageDefinition) error {
+	imagesLock.Lock()
+	defer imagesLock.Unlock()
+
+	for name, d := range defs {
+		if !IsValidImageName(name) {
+			return fmt.Errorf("Invalid image name '%s', only letters, digits, '_' and '-' may be used", name)
+		}
+		// Settings for a known image, such as those published by Solus,
+		// need not repeat where it comes from
+		if known, ok := images[name]; ok && d.URI == "" && !d.Local {
+			d.URI = known.URI
+			if d.Compression == "" {
+				d.Compression = known.Compression
+			}
+		}
+		if d.Compression == "" {
+			d.Compression = "xz"
+		}
+		d.Checksum = strings.ToLower(d.Checksum)
+		if err := d.Validate(); err != nil {
+			return fmt.Errorf("Invalid image '%s': %v", name, err)
+		}
+	}
+
+	for name, d := range defs {
+		log.WithFields(log.Fields{
+			"image": name,
+			"uri":   d.URI,
+		}).Debug("Registered image")
+		images[name] = d
+	}
+	return nil
+}
+
+// GetImage will return the definition of the named image, if known
+func GetImage(name string) (*ImageDefinition, bool) {
+	imagesLock.RLock()
+	defer imagesLock.RUnlock()
+	d, ok := images[name]
+	return d, ok
+}
+
+// ImageNames returns the names of all known images, sorted
+func ImageNames() []string {
+	imagesLock.RLock()
+	defer imagesLock.RUnlock()
+	var names []string
+	for name := range images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Decompress will decompress the downloaded image into place, removing the
+// compressed image once done.
+func (b *BackingImage) Decompress() error {
+	// Recorded in the metadata to trace the origin of the image
+	checksum, err := FileSha256sum(b.ImagePathXZ)
+	if err != nil {
+		return err
+	}
+
+	c := imageCompressors[b.Compression]
+	if c.tool == "" {
+		if err := os.Rename(b.ImagePathXZ, b.ImagePath); err != nil {
+			return err
+		}
+		return b.recordInit(b.ImageURI, checksum, nil)
+	}
+
+	tmp := b.ImagePath + ImagePartialSuffix
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(c.tool, "-dc", b.ImagePathXZ)
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, b.ImagePath); err != nil {
+		return err
+	}
+	if err := os.Remove(b.ImagePathXZ); err != nil {
+		return err
+	}
+	return b.recordInit(b.ImageURI, checksum, nil)
+}
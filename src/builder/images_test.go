@@ -0,0 +1,86 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"testing"
+)
+
+func TestRegisterImages(t *testing.T) {
+	defs := map[string]*ImageDefinition{
+		"derivative-x86_64": {
+			URI:         "https://images.example.com/derivative-x86_64.img.zst",
+			Compression: "zstd",
+		},
+	}
+	if err := RegisterImages(defs); err != nil {
+		t.Fatalf("Failed to register valid image: %v", err)
+	}
+	if !IsValidImage("derivative-x86_64") || !IsValidImage("main-x86_64") {
+		t.Fatalf("Registered images should be merged with the built-in images")
+	}
+
+	b := NewBackingImage("derivative-x86_64")
+	if b.ImageURI != defs["derivative-x86_64"].URI {
+		t.Fatalf("Wrong URI for registered image: %s", b.ImageURI)
+	}
+	if b.ImagePathXZ != "/var/lib/solbuild/images/derivative-x86_64.img.zst" {
+		t.Fatalf("Wrong download path for registered image: %s", b.ImagePathXZ)
+	}
+
+	bad := map[string]*ImageDefinition{
+		"no-uri":   {Compression: "xz"},
+		"bad-zip":  {URI: "https://images.example.com/a.img.bz2", Compression: "bzip2"},
+		"bad-sum":  {URI: "https://images.example.com/a.img.xz", Checksum: "abc"},
+		"bad.name": {URI: "https://images.example.com/a.img.xz"},
+	}
+	for name, d := range bad {
+		if err := RegisterImages(map[string]*ImageDefinition{name: d}); err == nil {
+			t.Fatalf("Should not be able to register invalid image '%s'", name)
+		}
+		if IsValidImage(name) {
+			t.Fatalf("Invalid image '%s' should not be registered", name)
+		}
+	}
+}
+
+func TestRegisterImagesBuiltin(t *testing.T) {
+	builtin, _ := GetImage("main-x86_64")
+	defer func() {
+		imagesLock.Lock()
+		images["main-x86_64"] = builtin
+		imagesLock.Unlock()
+	}()
+
+	if b := NewBackingImage("main-x86_64"); b.Checksum != "" || b.AllowUnverified {
+		t.Fatalf("Built-in image should be verified against the published checksum")
+	}
+
+	defs := map[string]*ImageDefinition{
+		"main-x86_64": {AllowUnverified: true},
+	}
+	if err := RegisterImages(defs); err != nil {
+		t.Fatalf("Failed to register settings for built-in image: %v", err)
+	}
+	b := NewBackingImage("main-x86_64")
+	if b.ImageURI != builtin.URI || b.ImagePathXZ != "/var/lib/solbuild/images/main-x86_64.img.xz" {
+		t.Fatalf("Built-in image should keep its URI, got: %s", b.ImageURI)
+	}
+	if !b.AllowUnverified {
+		t.Fatalf("Built-in image should allow unverified downloads once configured")
+	}
+}
@@ -74,6 +74,31 @@ func NewLockFile(path string) (*LockFile, error) {
 	return lock, nil
 }
 
+// ReadLockFile will return the existing lockfile at the given path without
+// attempting to lock it, so that its owner may be inspected.
+func ReadLockFile(path string) (*LockFile, error) {
+	lock := &LockFile{
+		path:      path,
+		owningPID: -1,
+		ourPID:    os.Getpid(),
+		conlock:   new(sync.RWMutex),
+	}
+	pid, err := lock.readPID()
+	if err != nil && err != ErrDeadLockFile {
+		return nil, err
+	}
+	lock.owningPID = pid
+	return lock, nil
+}
+
+// IsDead will determine whether the owner of the lockfile has gone away
+func (l *LockFile) IsDead() bool {
+	if l.owningPID <= 0 {
+		return true
+	}
+	return syscall.Kill(l.owningPID, syscall.Signal(0)) == syscall.ESRCH
+}
+
 // GetOwnerPID will return the owner PID, if it exists
 func (l *LockFile) GetOwnerPID() int {
 	return l.owningPID
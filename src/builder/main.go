@@ -75,14 +75,6 @@ const (
 	BuildUserShell = "/bin/bash"
 )
 
-var (
-	// ValidImages is a set of known, Solus-published, base profiles
-	ValidImages = []string{
-		"main-x86_64",
-		"unstable-x86_64",
-	}
-)
-
 // PathExists is a helper function to determine the existence of a file path
 func PathExists(path string) bool {
 	if st, err := os.Stat(path); err == nil && st != nil {
@@ -91,21 +83,17 @@ func PathExists(path string) bool {
 	return false
 }
 
-// IsValidImage will check if the specified profile is a valid one.
-func IsValidImage(profile string) bool {
-	for _, p := range ValidImages {
-		if p == profile {
-			return true
-		}
-	}
-	return false
+// IsValidImage will check if the specified image is a known one.
+func IsValidImage(image string) bool {
+	_, ok := GetImage(image)
+	return ok
 }
 
 // EmitImageError emits the stock response to requesting an invalid image
 func EmitImageError(image string) {
 	fmt.Fprintf(os.Stderr, "Error: '%v' is not a known image\n", image)
 	fmt.Fprintf(os.Stderr, "Valid images include:\n\n")
-	for _, p := range ValidImages {
+	for _, p := range ImageNames() {
 		fmt.Fprintf(os.Stderr, " * %v\n", p)
 	}
 }
@@ -134,10 +122,16 @@ func EmitProfileError(p string) {
 type BackingImage struct {
 	Name        string // Name of the profile
 	ImagePath   string // Absolute path to the .img file
-	ImagePathXZ string // Absolute path to the .img.xz file
+	ImagePathXZ string // Absolute path to the compressed image, i.e. .img.xz
 	ImageURI    string // URI of the image origin
 	RootDir     string // Where to mount the backing image for updates
 	LockPath    string // Our lock path for update operations
+
+	Checksum    string // Known sha256sum of the compressed image, if any
+	Compression string // Compression of the downloaded image
+
+	AllowUnverified bool // Whether the image may be used without a checksum
+	KeepSnapshots   int  // Previous generations kept when the image is replaced
 }
 
 // IsInstalled will determine whether the given backing image has been installed
@@ -146,20 +140,29 @@ func (b *BackingImage) IsInstalled() bool {
 	return PathExists(b.ImagePath)
 }
 
-// IsFetched will determine whether or not the XZ image itself has been fetched
+// IsFetched will determine whether or not the compressed image has been fetched
 func (b *BackingImage) IsFetched() bool {
 	return PathExists(b.ImagePathXZ)
 }
 
 // NewBackingImage will return a correctly configured backing image for
-// usage.
+// usage. Images missing from the registry are assumed to be published by
+// Solus.
 func NewBackingImage(name string) *BackingImage {
+	def, ok := GetImage(name)
+	if !ok {
+		def = solusImage(name)
+	}
 	return &BackingImage{
 		Name:        name,
 		ImagePath:   filepath.Join(ImagesDir, name+ImageSuffix),
-		ImagePathXZ: filepath.Join(ImagesDir, name+ImageCompressedSuffix),
-		ImageURI:    fmt.Sprintf("%s/%s%s", ImageBaseURI, name, ImageCompressedSuffix),
+		ImagePathXZ: filepath.Join(ImagesDir, name+def.Suffix()),
+		ImageURI:    def.URI,
 		LockPath:    filepath.Join(ImagesDir, name+".lock"),
 		RootDir:     filepath.Join(ImageRootsDir, name),
+		Checksum:    def.Checksum,
+		Compression: def.Compression,
+
+		AllowUnverified: def.AllowUnverified,
 	}
 }
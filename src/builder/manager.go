@@ -17,11 +17,13 @@
 package builder
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/solus-project/libosdev/disk"
+	"io"
 	"os"
-	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -51,6 +53,12 @@ var (
 
 	// ErrInterrupted is returned when the build is interrupted
 	ErrInterrupted = errors.New("The operation was cancelled by the user")
+
+	// ErrTimeout is returned when the build is stopped for taking too long
+	ErrTimeout = errors.New("The build exceeded its time limit")
+
+	// ErrNoKeptRoot is returned when resuming a root that was never kept
+	ErrNoKeptRoot = errors.New("No build root has been kept for this package")
 )
 
 // A Manager is responsible for cleanly managing the entire session within solbuild,
@@ -79,6 +87,23 @@ type Manager struct {
 	manifestTarget string // Generate manifest if set
 
 	activePID int // Active PID
+
+	subscribers []EventSubscriber // Receivers of build events
+
+	keepLog  bool      // Whether to keep a log of the build
+	buildLog *BuildLog // Active build log, if any
+
+	keepOnFailure bool // Whether to keep the root after a failed build
+	keepReport    bool // Whether to write a timing and resource report
+
+	cgroup *Cgroup // Resource limits for the build, if any
+
+	timeout time.Duration // Maximum duration of the build, if set
+	phase   string        // Current phase of the build
+	status  *LockStatus   // Status of the operation holding our lock
+
+	ctx    context.Context    // Context of the current operation
+	cancel context.CancelFunc // Cancels the current operation
 }
 
 // NewManager will return a newly initialised manager instance
@@ -105,6 +130,13 @@ func NewManager() (*Manager, error) {
 		return nil, err
 	}
 
+	if err := RegisterImages(man.config.Images); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to load image definitions")
+		return nil, err
+	}
+
 	man.lock = new(sync.Mutex)
 	return man, nil
 }
@@ -114,6 +146,195 @@ func (m *Manager) SetActivePID(pid int) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	m.activePID = pid
+
+	// Nothing new may start once we've been cancelled
+	if pid > 0 && m.cancelled {
+		syscall.Kill(-pid, syscall.SIGKILL)
+		syscall.Kill(pid, syscall.SIGKILL)
+		return
+	}
+}
+
+// CgroupPath returns the cgroup that processes run in the root must be
+// started in, if resource limits apply.
+func (m *Manager) CgroupPath() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.cgroup == nil {
+		return ""
+	}
+	return m.cgroup.Path
+}
+
+// AddSubscriber will register a new EventSubscriber to receive all build
+// events emitted by this manager.
+func (m *Manager) AddSubscriber(s EventSubscriber) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.subscribers = append(m.subscribers, s)
+}
+
+// EmitEvent will notify all subscribers of the given event
+func (m *Manager) EmitEvent(t EventType) {
+	m.emitEvent(t, nil)
+}
+
+// emitEvent constructs the Event for the current package and hands it to
+// each of the subscribers. The lock is only held to take a copy of the
+// subscriber list, so that subscribers may call back into the manager.
+func (m *Manager) emitEvent(t EventType, err error) {
+	m.lock.Lock()
+	if next := PhaseAfter(t); next != "" {
+		m.setPhase(next)
+	}
+	subscribers := m.subscribers
+	e := &Event{
+		Type: t,
+		Time: time.Now().UTC(),
+	}
+	if m.profile != nil {
+		e.Profile = m.profile.Name
+	}
+	if m.pkg != nil {
+		e.Package = m.pkg.Name
+		e.Version = m.pkg.Version
+		e.Release = m.pkg.Release
+		e.Commit = m.pkg.Commit
+	}
+	m.lock.Unlock()
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	for _, s := range subscribers {
+		s.HandleEvent(e)
+	}
+}
+
+// SetBuildLog will enable or disable capturing all build output to a log
+// file, which is collected alongside the build artifacts.
+func (m *Manager) SetBuildLog(enable bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.keepLog = enable
+}
+
+// GetOutput will return the output streams for processes run in the build
+// root, tee'd to the build log if one is active.
+func (m *Manager) GetOutput() (io.Writer, io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.buildLog == nil {
+		return os.Stdout, os.Stderr
+	}
+	return m.buildLog.Stdout(), m.buildLog.Stderr()
+}
+
+// startBuildLog will open the build log for the overlay and subscribe it
+// to the build events so that each phase is marked in the log.
+func (m *Manager) startBuildLog() error {
+	m.overlay.LogPath = m.overlay.BaseDir + BuildLogSuffix
+	buildLog, err := NewBuildLog(m.overlay.LogPath)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path":  m.overlay.LogPath,
+			"error": err,
+		}).Error("Failed to create build log")
+		return err
+	}
+	m.AddSubscriber(buildLog)
+	m.lock.Lock()
+	m.buildLog = buildLog
+	m.lock.Unlock()
+	return nil
+}
+
+// stopBuildLog will close the active build log, if any
+func (m *Manager) stopBuildLog() {
+	m.lock.Lock()
+	buildLog := m.buildLog
+	m.buildLog = nil
+	m.lock.Unlock()
+
+	if buildLog != nil {
+		buildLog.Close()
+	}
+}
+
+// applyLimits will create the named cgroup for the operation if the
+// configuration or profile set any resource limits. Every process run in the
+// root is then started within it.
+func (m *Manager) applyLimits(name string) error {
+	limits := m.config.Limits
+	if m.profile != nil {
+		limits = limits.Merge(m.profile.Limits)
+	}
+	if limits.IsEmpty() {
+		return nil
+	}
+	cgroup := NewCgroup(name, limits)
+	if err := cgroup.Create(); err != nil {
+		log.WithFields(log.Fields{
+			"cgroup": cgroup.Path,
+			"error":  err,
+		}).Error("Failed to create cgroup for resource limits")
+		cgroup.Destroy()
+		return err
+	}
+	m.lock.Lock()
+	m.cgroup = cgroup
+	m.lock.Unlock()
+	return nil
+}
+
+// SetReport will enable or disable writing a report of the time and
+// resources used by each phase of the build, alongside the artifacts.
+func (m *Manager) SetReport(enable bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.keepReport = enable
+}
+
+// collectReport will hand the build report back to the user
+func (m *Manager) collectReport(report *BuildReport) {
+	if m.cgroup != nil {
+		if peak, err := m.cgroup.MemoryPeak(); err == nil {
+			report.SetMemoryPeak(peak)
+		}
+	}
+	if err := m.pkg.CollectReport(report, m.overlay, GetUserInfo()); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to write build report")
+	}
+}
+
+// SetKeepOnFailure will cause the build root to be kept for inspection if
+// the build fails, so that it may be entered again with ChrootResume.
+func (m *Manager) SetKeepOnFailure(keep bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.keepOnFailure = keep
+}
+
+// keepRoot will mark the root of a failed build as kept. Nothing of a tmpfs
+// root survives the build, so there is nothing to keep.
+func (m *Manager) keepRoot(reason error) {
+	if m.overlay.EnableTmpfs {
+		log.Warning("Cannot keep the build root of a tmpfs build")
+		return
+	}
+	if err := m.overlay.Keep(reason); err != nil {
+		log.WithFields(log.Fields{
+			"path":  m.overlay.KeepPath,
+			"error": err,
+		}).Error("Failed to keep build root")
+		return
+	}
+	log.WithFields(log.Fields{
+		"root": m.overlay.BaseDir,
+	}).Info("Build root kept, enter it with chroot --resume")
 }
 
 // SetManifestTarget will set the manifest target to be used
@@ -154,6 +375,7 @@ func (m *Manager) SetProfile(profile string) error {
 
 	m.profile = prof
 	m.image = NewBackingImage(m.profile.Image)
+	m.image.KeepSnapshots = m.config.ImageSnapshots
 	return nil
 }
 
@@ -164,6 +386,23 @@ func (m *Manager) GetProfile() *Profile {
 	return m.profile
 }
 
+// FetchImage will download the compressed backing image of the profile,
+// using any mirrors in the configuration.
+func (m *Manager) FetchImage(ctx context.Context) error {
+	m.lock.Lock()
+	image := m.image
+	mirrors := m.config.ImageMirrors
+	m.lock.Unlock()
+
+	if image == nil {
+		return ErrInvalidImage
+	}
+	if image.ImageURI == "" {
+		return ErrLocalImage
+	}
+	return image.Fetch(ctx, mirrors)
+}
+
 // SetPackage will set the package associated with this manager.
 // This package will be used in build & chroot operations only.
 func (m *Manager) SetPackage(pkg *Package) error {
@@ -208,33 +447,86 @@ func (m *Manager) IsCancelled() bool {
 }
 
 // SetCancelled will mark the build manager as cancelled, so it should not attempt
-// to start any new operations whatsoever.
+// to start any new operations whatsoever. Any operation in progress is stopped,
+// and will return ErrInterrupted once it has cleaned up.
 func (m *Manager) SetCancelled() {
 	m.lock.Lock()
-	defer m.lock.Unlock()
 	m.cancelled = true
+	cancel := m.cancel
+	m.lock.Unlock()
+
+	if cancel != nil {
+		cancel()
+	}
 }
 
-// Cleanup will take care of any teardown operations. It takes an exclusive lock
-// and ensures all cleaning is handled before anyone else is permitted to continue,
-// at which point error propagation and the IsCancelled() function should be enough
-// logic to go on.
-func (m *Manager) Cleanup() {
-	if !m.didStart {
-		return
+// Kill will cancel the current operation and immediately kill every process
+// it has running, without waiting for the StopGracePeriod. Cleanup still
+// happens once the operation returns.
+func (m *Manager) Kill() {
+	m.SetCancelled()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.cgroup != nil {
+		m.cgroup.Kill()
 	}
-	log.Debug("Acquiring global lock")
+	if m.activePID > 0 {
+		syscall.Kill(-m.activePID, syscall.SIGKILL)
+		syscall.Kill(m.activePID, syscall.SIGKILL)
+	}
+}
+
+// Context returns the context of the current operation, allowing the processes
+// run by the operation to be stopped when it is cancelled.
+func (m *Manager) Context() context.Context {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	log.Debug("Cleaning up")
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
+}
 
-	if m.pkgManager != nil {
-		// Potentially unnecessary but meh
-		m.pkgManager.StopDBUS()
-		// Always needed
-		m.pkgManager.Cleanup()
+// begin will derive the context for a new operation from the one passed by
+// the caller, returning the function to release it once the operation is done.
+func (m *Manager) begin(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
 	}
+	m.lock.Lock()
+	m.ctx = ctx
+	m.cancel = cancel
+	m.lock.Unlock()
+	return ctx, cancel
+}
+
+// contextError will translate the error from an operation whose context
+// is done into ErrTimeout or ErrInterrupted.
+func (m *Manager) contextError(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		m.lock.Lock()
+		log.WithFields(log.Fields{
+			"phase": m.phase,
+		}).Error("Operation timed out")
+		m.lock.Unlock()
+		return ErrTimeout
+	case context.Canceled:
+		return ErrInterrupted
+	}
+	return err
+}
 
+// killProcesses will kill every process running within the root, returning
+// the root. The caller must hold the lock.
+func (m *Manager) killProcesses() string {
 	deathPoint := ""
 	if m.overlay != nil {
 		deathPoint = m.overlay.MountPoint
@@ -243,6 +535,11 @@ func (m *Manager) Cleanup() {
 		deathPoint = m.image.RootDir
 	}
 
+	// Everything in the cgroup belongs to the build
+	if m.cgroup != nil {
+		m.cgroup.Kill()
+	}
+
 	// Try to kill the active root PID first
 	if m.activePID > 0 {
 		syscall.Kill(-m.activePID, syscall.SIGKILL)
@@ -257,6 +554,49 @@ func (m *Manager) Cleanup() {
 			MurderDeathKill(deathPoint)
 		}
 	}
+	return deathPoint
+}
+
+// SetTimeout will bound the duration of the build. A zero timeout will use
+// the configured build_timeout, if any.
+func (m *Manager) SetTimeout(timeout time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.timeout = timeout
+}
+
+// buildTimeout returns the timeout for the build, falling back to the
+// configured build_timeout.
+func (m *Manager) buildTimeout() (time.Duration, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.timeout != 0 {
+		return m.timeout, nil
+	}
+	return m.config.Timeout()
+}
+
+// Cleanup will take care of any teardown operations. It takes an exclusive lock
+// and ensures all cleaning is handled before anyone else is permitted to continue,
+// at which point error propagation and the IsCancelled() function should be enough
+// logic to go on.
+func (m *Manager) Cleanup() {
+	if !m.didStart {
+		return
+	}
+	log.Debug("Acquiring global lock")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	log.Debug("Cleaning up")
+
+	if m.pkgManager != nil {
+		// Potentially unnecessary but meh
+		m.pkgManager.StopDBUS()
+		// Always needed
+		m.pkgManager.Cleanup()
+	}
+
+	deathPoint := m.killProcesses()
 
 	if m.pkg != nil {
 		m.pkg.DeactivateRoot(m.overlay)
@@ -270,7 +610,27 @@ func (m *Manager) Cleanup() {
 	// Unmount anything we may have mounted
 	disk.GetMountManager().UnmountAll()
 
+	m.removeBuildFiles()
+
+	if m.cgroup != nil {
+		if err := m.cgroup.Destroy(); err != nil {
+			log.WithFields(log.Fields{
+				"cgroup": m.cgroup.Path,
+				"error":  err,
+			}).Error("Failed to remove build cgroup")
+		}
+		m.cgroup = nil
+	}
+
 	// Finally clean out the lock files
+	if m.status != nil {
+		if err := m.status.Remove(); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Error("Failure in removing status file")
+		}
+		m.status = nil
+	}
 	if m.lockfile != nil {
 		if err := m.lockfile.Unlock(); err != nil {
 			log.WithFields(log.Fields{
@@ -314,26 +674,50 @@ func (m *Manager) doLock(path, opType string) error {
 		return err
 	}
 	m.didStart = true
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.status = &LockStatus{
+		LockPath:  path,
+		Operation: opType,
+		Phase:     m.phase,
+		Started:   time.Now().UTC(),
+	}
+	if m.profile != nil {
+		m.status.Profile = m.profile.Name
+	}
+	if m.pkg != nil {
+		m.status.Package = m.pkg.Name
+	}
+	m.writeStatus()
 	return nil
 }
 
-// SigIntCleanup will take care of cleaning up the build process.
-func (m *Manager) SigIntCleanup() {
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-	go func() {
-		<-ch
-		log.Warning("CTRL+C interrupted, cleaning up")
-		m.SetCancelled()
-		m.Cleanup()
-		log.Error("Exiting due to interruption")
-		os.Exit(1)
-	}()
+// setPhase will record the phase the operation is in. The caller must hold
+// the lock.
+func (m *Manager) setPhase(phase string) {
+	m.phase = phase
+	if m.status != nil {
+		m.status.Phase = phase
+		m.writeStatus()
+	}
+}
+
+// writeStatus will update the status file for our lock. The caller must hold
+// the lock.
+func (m *Manager) writeStatus() {
+	if err := m.status.Write(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"file":  StatusPath(m.status.LockPath),
+		}).Warning("Failed to write status file")
+	}
 }
 
 // Build will attempt to build the package associated with this manager,
-// automatically handling any required cleanups.
-func (m *Manager) Build() error {
+// automatically handling any required cleanups. The build is stopped if the
+// context is cancelled.
+func (m *Manager) Build(ctx context.Context) error {
 	if m.IsCancelled() {
 		return ErrInterrupted
 	}
@@ -345,23 +729,138 @@ func (m *Manager) Build() error {
 	}
 	m.lock.Unlock()
 
+	timeout, err := m.buildTimeout()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid build timeout")
+		return err
+	}
+
 	// Now get on with the real work!
 	defer m.Cleanup()
-	m.SigIntCleanup()
+	ctx, cancel := m.begin(ctx, timeout)
+	defer cancel()
 
 	// Now set our options according to the config
 	m.overlay.EnableTmpfs = m.config.EnableTmpfs
 	m.overlay.TmpfsSize = m.config.TmpfsSize
 
 	if err := m.doLock(m.overlay.LockPath, "building"); err != nil {
+		m.emitEvent(EventBuildFailed, err)
+		return err
+	}
+
+	if m.keepLog {
+		if err := m.startBuildLog(); err != nil {
+			return err
+		}
+		defer m.stopBuildLog()
+	}
+
+	var report *BuildReport
+	if m.keepReport {
+		report = NewBuildReport()
+		m.AddSubscriber(report)
+		defer m.collectReport(report)
+	}
+
+	// Limits apply to everything run for the build, including any refresh
+	if err := m.applyLimits(fmt.Sprintf("%s.%s", m.profile.Name, m.pkg.Name)); err != nil {
+		m.emitEvent(EventBuildFailed, err)
 		return err
 	}
 
-	return m.pkg.Build(m, m.history, m.GetProfile(), m.pkgManager, m.overlay, m.manifestTarget)
+	m.lock.Lock()
+	m.setPhase(PhaseRefreshImage)
+	m.lock.Unlock()
+
+	if err := m.refreshImage(ctx); err != nil {
+		m.emitEvent(EventBuildFailed, m.contextError(ctx, err))
+		return m.contextError(ctx, err)
+	}
+
+	if report != nil {
+		meta, err := m.image.ReadMetadata()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"image": m.image.Name,
+				"error": err,
+			}).Warning("Failed to read image metadata for the report")
+		}
+		report.SetImage(meta)
+	}
+
+	m.lock.Lock()
+	m.setPhase(PhaseMount)
+	m.lock.Unlock()
+
+	if err := m.pkg.Build(ctx, m, m.history, m.GetProfile(), m.pkgManager, m.overlay, m.manifestTarget); err != nil {
+		// Report a limit breach over whatever the build made of it
+		if m.cgroup != nil {
+			if breach := m.cgroup.Breach(); breach != nil {
+				log.WithFields(log.Fields{
+					"error": breach,
+				}).Error("Build exceeded resource limits")
+				err = breach
+			}
+		}
+		err = m.contextError(ctx, err)
+		m.emitEvent(EventBuildFailed, err)
+
+		// Still hand the log back, it's most useful when things go wrong
+		m.stopBuildLog()
+		m.pkg.CollectLog(m.overlay, GetUserInfo())
+		m.pkg.CollectPackagesManifest(m.overlay, GetUserInfo())
+
+		if m.keepOnFailure {
+			m.keepRoot(err)
+		}
+		return err
+	}
+
+	// Only now is the log complete
+	m.stopBuildLog()
+	return m.pkg.CollectLog(m.overlay, GetUserInfo())
+}
+
+// removeBuildFiles will delete the files written alongside the build root
+// once they've been collected.
+func (m *Manager) removeBuildFiles() {
+	if m.overlay == nil {
+		return
+	}
+	paths := []string{
+		m.overlay.LogPath,
+		packagesManifestPath(m.overlay),
+		m.overlay.BaseDir + BuildReportSuffix,
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"path":  path,
+				"error": err,
+			}).Error("Failed to remove build file")
+		}
+	}
 }
 
 // Chroot will enter the build environment to allow users to introspect it
-func (m *Manager) Chroot() error {
+func (m *Manager) Chroot(ctx context.Context) error {
+	return m.chroot(ctx, false)
+}
+
+// ChrootResume will enter the root kept from a failed build, exactly as the
+// build left it.
+func (m *Manager) ChrootResume(ctx context.Context) error {
+	return m.chroot(ctx, true)
+}
+
+// chroot will enter the build environment, resuming a kept root if requested
+func (m *Manager) chroot(ctx context.Context, resume bool) error {
 	if m.IsCancelled() {
 		return ErrInterrupted
 	}
@@ -375,17 +874,35 @@ func (m *Manager) Chroot() error {
 
 	// Now get on with the real work!
 	defer m.Cleanup()
-	m.SigIntCleanup()
+	ctx, cancel := m.begin(ctx, 0)
+	defer cancel()
 
 	if err := m.doLock(m.overlay.LockPath, "chroot"); err != nil {
 		return err
 	}
 
-	return m.pkg.Chroot(m, m.pkgManager, m.overlay)
+	if err := m.applyLimits(fmt.Sprintf("%s.%s", m.profile.Name, m.pkg.Name)); err != nil {
+		return err
+	}
+
+	if resume {
+		if !m.overlay.IsKept() {
+			return ErrNoKeptRoot
+		}
+		if when, reason, err := m.overlay.KeptReason(); err == nil {
+			log.WithFields(log.Fields{
+				"failed": when.Local().Format(time.RFC1123),
+				"error":  reason,
+			}).Info("Resuming failed build root")
+		}
+	}
+
+	err := m.pkg.Chroot(m, m.pkgManager, m.overlay, resume)
+	return m.contextError(ctx, err)
 }
 
 // Update will attempt to update the base image
-func (m *Manager) Update() error {
+func (m *Manager) Update(ctx context.Context) error {
 	if m.IsCancelled() {
 		return ErrInterrupted
 	}
@@ -403,17 +920,226 @@ func (m *Manager) Update() error {
 	m.lock.Unlock()
 
 	defer m.Cleanup()
-	m.SigIntCleanup()
+	ctx, cancel := m.begin(ctx, 0)
+	defer cancel()
 
 	if err := m.doLock(m.image.LockPath, "updating"); err != nil {
 		return err
 	}
 
-	return m.image.Update(m, m.pkgManager)
+	if err := m.applyLimits("image." + m.image.Name); err != nil {
+		return err
+	}
+
+	err := m.updateImage(m.pkgManager)
+	return m.contextError(ctx, err)
+}
+
+// updateImage will update the image, keeping the previous image as a
+// snapshot in case the update breaks it. The caller must hold the image lock.
+func (m *Manager) updateImage(pkgManager *EopkgManager) error {
+	return m.image.Update(m, pkgManager)
+}
+
+// refreshImage will apply the image age policy before a build. Images older
+// than the maximum age are updated under the image lock, so that each build
+// doesn't need to upgrade the same packages again. A failed update leaves
+// the image intact, so the build goes ahead with it.
+func (m *Manager) refreshImage(ctx context.Context) error {
+	maxAge, err := m.config.MaxAge()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Invalid maximum image age")
+		return err
+	}
+	if maxAge <= 0 {
+		return nil
+	}
+	age, err := m.image.Age()
+	if err != nil {
+		return err
+	}
+	if age <= maxAge {
+		return nil
+	}
+
+	fields := log.Fields{
+		"image":   m.image.Name,
+		"age":     age.Round(time.Minute),
+		"max_age": maxAge,
+	}
+	switch m.config.ImageAgePolicy {
+	case ImageAgeWarn:
+		log.WithFields(fields).Warning("Image is older than the maximum age, consider updating it")
+		return nil
+	case ImageAgeUpdate:
+	default:
+		return fmt.Errorf("Unknown image age policy: %s", m.config.ImageAgePolicy)
+	}
+
+	lock, err := NewLockFile(m.image.LockPath)
+	if err != nil {
+		return err
+	}
+	defer lock.Clean()
+	if err := lock.Lock(); err != nil {
+		log.WithFields(log.Fields{
+			"image": m.image.Name,
+			"pid":   lock.GetOwnerPID(),
+		}).Warning("Image is too old, but is locked by another process")
+		return nil
+	}
+	defer lock.Unlock()
+
+	status := &LockStatus{
+		LockPath:  m.image.LockPath,
+		Operation: "updating",
+		Profile:   m.image.Name,
+		Started:   time.Now().UTC(),
+	}
+	status.Write()
+	defer status.Remove()
+
+	log.WithFields(fields).Info("Image is older than the maximum age, updating it")
+	pkgManager := NewEopkgManager(m, m.image.RootDir)
+	if err := m.updateImage(pkgManager); err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"image": m.image.Name,
+			"error": err,
+		}).Error("Failed to update image, building with the previous image")
+		m.image.unmountRoot(pkgManager)
+	}
+	return nil
+}
+
+// CheckImage will check the health of the named image and, if requested,
+// attempt to repair any problems found. The returned health is that of the
+// image after any repair.
+func (m *Manager) CheckImage(ctx context.Context, name string, repair bool) (*ImageHealth, error) {
+	if m.IsCancelled() {
+		return nil, ErrInterrupted
+	}
+	if !IsValidImage(name) {
+		return nil, ErrInvalidImage
+	}
+	m.lock.Lock()
+	if m.image != nil {
+		m.lock.Unlock()
+		return nil, ErrManagerInitialised
+	}
+	m.image = NewBackingImage(name)
+	m.image.KeepSnapshots = m.config.ImageSnapshots
+	m.updateMode = true
+	m.pkgManager = NewEopkgManager(m, m.image.RootDir)
+	m.lock.Unlock()
+
+	defer m.Cleanup()
+	ctx, cancel := m.begin(ctx, 0)
+	defer cancel()
+
+	if err := m.doLock(m.image.LockPath, "checking"); err != nil {
+		return nil, err
+	}
+
+	h, err := m.image.Check(m)
+	if err != nil || !repair || h.IsHealthy() {
+		return h, m.contextError(ctx, err)
+	}
+	if err := m.image.Repair(m, m.pkgManager, h); err != nil {
+		return h, m.contextError(ctx, err)
+	}
+	h, err = m.image.Check(m)
+	return h, m.contextError(ctx, err)
+}
+
+// RollbackImage will replace the named image with the snapshot of the given
+// generation, or the newest snapshot if generation is 0.
+func (m *Manager) RollbackImage(name string, generation int) (*ImageSnapshot, error) {
+	if m.IsCancelled() {
+		return nil, ErrInterrupted
+	}
+	if !IsValidImage(name) {
+		return nil, ErrInvalidImage
+	}
+	m.lock.Lock()
+	if m.image != nil {
+		m.lock.Unlock()
+		return nil, ErrManagerInitialised
+	}
+	m.image = NewBackingImage(name)
+	m.lock.Unlock()
+
+	defer m.Cleanup()
+	if err := m.doLock(m.image.LockPath, "rolling back"); err != nil {
+		return nil, err
+	}
+	return m.image.Rollback(generation)
+}
+
+// UndoRollbackImage will restore the named image as it was before its last
+// rollback.
+func (m *Manager) UndoRollbackImage(name string) error {
+	if m.IsCancelled() {
+		return ErrInterrupted
+	}
+	if !IsValidImage(name) {
+		return ErrInvalidImage
+	}
+	m.lock.Lock()
+	if m.image != nil {
+		m.lock.Unlock()
+		return ErrManagerInitialised
+	}
+	m.image = NewBackingImage(name)
+	m.image.KeepSnapshots = m.config.ImageSnapshots
+	m.lock.Unlock()
+
+	defer m.Cleanup()
+	if err := m.doLock(m.image.LockPath, "rolling back"); err != nil {
+		return err
+	}
+	return m.image.Undo()
+}
+
+// CreateImage will bootstrap a new backing image from the recipe, and
+// register it so that profiles may use it.
+func (m *Manager) CreateImage(ctx context.Context, r *ImageRecipe) error {
+	if m.IsCancelled() {
+		return ErrInterrupted
+	}
+	if IsValidImage(r.Name) {
+		return ErrImageExists
+	}
+	m.lock.Lock()
+	if m.image != nil {
+		m.lock.Unlock()
+		return ErrManagerInitialised
+	}
+	m.image = NewBackingImage(r.Name)
+	m.updateMode = true
+	m.pkgManager = NewEopkgManager(m, m.image.RootDir)
+	m.lock.Unlock()
+
+	defer m.Cleanup()
+	ctx, cancel := m.begin(ctx, 0)
+	defer cancel()
+
+	if err := m.doLock(m.image.LockPath, "creating"); err != nil {
+		return err
+	}
+
+	if err := m.image.Create(m, m.pkgManager, r); err != nil {
+		return m.contextError(ctx, err)
+	}
+	return RegisterLocalImage(r.Name)
 }
 
 // Index will attempt to index the given directory for eopkgs
-func (m *Manager) Index(dir string) error {
+func (m *Manager) Index(ctx context.Context, dir string) error {
 	if m.IsCancelled() {
 		return ErrInterrupted
 	}
@@ -427,7 +1153,8 @@ func (m *Manager) Index(dir string) error {
 
 	// Now get on with the real work!
 	defer m.Cleanup()
-	m.SigIntCleanup()
+	ctx, cancel := m.begin(ctx, 0)
+	defer cancel()
 
 	// Now set our options according to the config
 	m.overlay.EnableTmpfs = m.config.EnableTmpfs
@@ -437,7 +1164,8 @@ func (m *Manager) Index(dir string) error {
 		return err
 	}
 
-	return m.pkg.Index(m, dir, m.overlay)
+	err := m.pkg.Index(m, dir, m.overlay)
+	return m.contextError(ctx, err)
 }
 
 // SetTmpfs sets the manager tmpfs option
@@ -21,8 +21,11 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/solus-project/libosdev/commands"
 	"github.com/solus-project/libosdev/disk"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 const (
@@ -44,6 +47,8 @@ type Overlay struct {
 	ImgDir     string // Where the profile is mounted (ro)
 	MountPoint string // The actual mount point for the union'd directories
 	LockPath   string // Path to the lockfile for this overlay
+	LogPath    string // Path to the build log, if one is being kept
+	KeepPath   string // Marks the root as kept after a failed build
 
 	EnableTmpfs bool   // Whether to use tmpfs for the upperdir or not
 	TmpfsSize   string // Size of the tmpfs to pass to mount, string form
@@ -74,6 +79,7 @@ func NewOverlay(profile *Profile, back *BackingImage, pkg *Package) *Overlay {
 		ImgDir:         filepath.Join(basedir, "img"),
 		MountPoint:     filepath.Join(basedir, "union"),
 		LockPath:       fmt.Sprintf("%s.lock", basedir),
+		KeepPath:       fmt.Sprintf("%s.keep", basedir),
 		mountedImg:     false,
 		mountedOverlay: false,
 		mountedVFS:     false,
@@ -114,6 +120,14 @@ func (o *Overlay) EnsureDirs() error {
 // CleanExisting will purge an existing overlayfs configuration if it
 // exists.
 func (o *Overlay) CleanExisting() error {
+	if PathExists(o.KeepPath) {
+		log.WithFields(log.Fields{
+			"dir": o.BaseDir,
+		}).Info("Discarding root kept from a failed build")
+		if err := os.Remove(o.KeepPath); err != nil {
+			return err
+		}
+	}
 	if !PathExists(o.BaseDir) {
 		return nil
 	}
@@ -130,6 +144,40 @@ func (o *Overlay) CleanExisting() error {
 	return nil
 }
 
+// Keep will mark the root as kept for later inspection, recording why the
+// build failed. The root itself is left as is, and survives until the next
+// build of the package cleans it.
+func (o *Overlay) Keep(reason error) error {
+	msg := fmt.Sprintf("%s\n", time.Now().UTC().Format(time.RFC3339))
+	if reason != nil {
+		msg += fmt.Sprintf("%v\n", reason)
+	}
+	return ioutil.WriteFile(o.KeepPath, []byte(msg), 00644)
+}
+
+// IsKept will determine whether the root was kept after a failed build
+func (o *Overlay) IsKept() bool {
+	return PathExists(o.KeepPath)
+}
+
+// KeptReason returns the time and reason recorded when the root was kept
+func (o *Overlay) KeptReason() (time.Time, string, error) {
+	data, err := ioutil.ReadFile(o.KeepPath)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	lines := strings.SplitN(string(data), "\n", 2)
+	when, err := time.Parse(time.RFC3339, lines[0])
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	reason := ""
+	if len(lines) > 1 {
+		reason = strings.TrimSpace(lines[1])
+	}
+	return when, reason, nil
+}
+
 // Mount will set up the overlayfs structure with the lower/upper respected
 // properly.
 func (o *Overlay) Mount() error {
@@ -0,0 +1,173 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/solus-project/libosdev/disk"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PackagesManifestSuffix is appended to the package name, version and
+// release to form the name of the installed packages manifest.
+const PackagesManifestSuffix = ".packages.json"
+
+// An InstalledPackage is a package installed in an image or build root
+type InstalledPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release int    `json:"release"`
+}
+
+// A PackagesManifest lists every package installed in the build root at the
+// moment the build began.
+type PackagesManifest struct {
+	Package  string              `json:"package"`
+	Version  string              `json:"version"`
+	Release  int                 `json:"release"`
+	Image    string              `json:"image"`
+	Created  time.Time           `json:"created"`
+	Packages []*InstalledPackage `json:"packages"`
+}
+
+// ListInstalledPackages returns every package installed in the root, sorted
+// by name.
+func ListInstalledPackages(root string) ([]*InstalledPackage, error) {
+	entries, err := packageEntries(root)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []*InstalledPackage
+	for name, dir := range entries {
+		// Entries are named $name-$version-$release
+		fields := strings.Split(filepath.Base(dir), "-")
+		release, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid package database entry: %s", filepath.Base(dir))
+		}
+		pkgs = append(pkgs, &InstalledPackage{
+			Name:    name,
+			Version: fields[len(fields)-2],
+			Release: release,
+		})
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].Name < pkgs[j].Name
+	})
+	return pkgs, nil
+}
+
+// mountReadOnly will mount the image read-only on a temporary directory
+// outside of the solbuild trees, so that recovery never mistakes it for a
+// stale build, and call fn with the root.
+func (b *BackingImage) mountReadOnly(fn func(root string) error) error {
+	if !b.IsInstalled() {
+		return ErrImageNotInstalled
+	}
+	dir, err := ioutil.TempDir("", "solbuild-"+b.Name+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+
+	mountMan := disk.GetMountManager()
+	if err := mountMan.Mount(b.ImagePath, dir, "auto", "loop", "ro"); err != nil {
+		log.WithFields(log.Fields{
+			"image": b.ImagePath,
+			"error": err,
+		}).Error("Failed to mount image")
+		return err
+	}
+	defer mountMan.Unmount(dir)
+
+	return fn(dir)
+}
+
+// Packages will mount the image read-only on a temporary directory and
+// return every package installed in it. A temporary directory is used so
+// that this may be done while the image is being updated.
+func (b *BackingImage) Packages() ([]*InstalledPackage, error) {
+	var pkgs []*InstalledPackage
+	err := b.mountReadOnly(func(root string) error {
+		var err error
+		pkgs, err = ListInstalledPackages(root)
+		return err
+	})
+	return pkgs, err
+}
+
+// packagesManifestPath returns the path of the manifest for the build
+func packagesManifestPath(overlay *Overlay) string {
+	return overlay.BaseDir + PackagesManifestSuffix
+}
+
+// WritePackagesManifest will record the packages installed in the build
+// root, to trace what the package was built against after the fact.
+func (p *Package) WritePackagesManifest(overlay *Overlay) error {
+	path := packagesManifestPath(overlay)
+	// Never collect the manifest of an earlier build
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	pkgs, err := ListInstalledPackages(overlay.MountPoint)
+	if err != nil {
+		return err
+	}
+	manifest := &PackagesManifest{
+		Package:  p.Name,
+		Version:  p.Version,
+		Release:  p.Release,
+		Image:    overlay.Back.Name,
+		Created:  time.Now().UTC(),
+		Packages: pkgs,
+	}
+	blob, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(blob, '\n'), 00644)
+}
+
+// writePackagesManifest will write the manifest, logging any failure, as it
+// shouldn't prevent the build.
+func (p *Package) writePackagesManifest(overlay *Overlay) {
+	if err := p.WritePackagesManifest(overlay); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to write installed packages manifest")
+	}
+}
+
+// CollectPackagesManifest will copy the installed packages manifest, if one
+// was written, back to the users current directory as
+// $name-$version-$release.packages.json
+func (p *Package) CollectPackagesManifest(overlay *Overlay, usr *UserInfo) error {
+	path := packagesManifestPath(overlay)
+	if !PathExists(path) {
+		return nil
+	}
+	name := fmt.Sprintf("%s-%s-%d%s", p.Name, p.Version, p.Release, PackagesManifestSuffix)
+	return collectFile(path, name, usr)
+}
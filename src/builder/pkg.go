@@ -51,6 +51,10 @@ var (
 		Release: 1,
 		Path:    "",
 	}
+
+	// ErrInvalidBuildDir is returned when the build directory isn't a plain
+	// directory name
+	ErrInvalidBuildDir = errors.New("The build directory must be a single directory name")
 )
 
 // Package is the main item we deal with, avoiding the internals
@@ -62,6 +66,13 @@ type Package struct {
 	Path       string          // Path to the build spec
 	Sources    []source.Source // Each package has 0 or more sources that we fetch
 	CanNetwork bool            // Only applicable to ypkg builds
+
+	BuildDeps   []string // Build dependencies, only known for ypkg builds
+	SubPackages []string // Explicitly named subpackages, ypkg only
+
+	BuildDirName string // Build within this directory of the build user's home
+	Timezone     string // Passed to all processes in the build as TZ, if set
+	Commit       string // Commit the spec was built from, for git builds
 }
 
 // YmlPackage is a parsed ypkg build file
@@ -71,6 +82,8 @@ type YmlPackage struct {
 	Release    int
 	Networking bool // If set to false (default) we disable networking in the build
 	Source     []map[string]string
+	BuildDeps  []string                 `yaml:"builddeps"`
+	Patterns   []map[string]interface{} // Only the keys are used, to find subpackages
 }
 
 // XMLUpdate represents an update in the package history
@@ -208,6 +221,20 @@ func NewYmlPackageFromBytes(by []byte) (*Package, error) {
 		CanNetwork: ypkg.Networking,
 	}
 
+	ret.BuildDeps = ypkg.BuildDeps
+
+	// "devel" is a subpackage of ours, "^name" is an explicit package name
+	for _, row := range ypkg.Patterns {
+		for key := range row {
+			key = strings.TrimSpace(key)
+			if strings.HasPrefix(key, "^") {
+				ret.SubPackages = append(ret.SubPackages, key[1:])
+			} else {
+				ret.SubPackages = append(ret.SubPackages, fmt.Sprintf("%s-%s", ret.Name, key))
+			}
+		}
+	}
+
 	for _, row := range ypkg.Source {
 		for key, value := range row {
 			source, err := source.New(key, value, false)
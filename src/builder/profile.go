@@ -42,6 +42,7 @@ type Profile struct {
 	RemoveRepos []string         `toml:"remove_repos"` // A set of repos to remove. ["*"] is valid here.
 	Repos       map[string]*Repo `toml:"repo"`         // Allow defining custom repos
 	AddRepos    []string         `toml:"add_repos"`    // Allow locking to a single set of repos
+	Limits      ResourceLimits   `toml:"limits"`       // Override the configured resource limits
 }
 
 var (
@@ -127,3 +128,56 @@ func NewProfileFromPath(path string) (*Profile, error) {
 
 	return profile, nil
 }
+
+// EnabledRepos will return the set of repos this profile adds to the build
+// root, which is every defined repo unless add_repos restricts it.
+func (p *Profile) EnabledRepos() []*Repo {
+	var repos []*Repo
+
+	if (len(p.AddRepos) == 1 && p.AddRepos[0] == "*") || len(p.AddRepos) == 0 {
+		for _, repo := range p.Repos {
+			repos = append(repos, repo)
+		}
+	} else {
+		for _, id := range p.AddRepos {
+			repos = append(repos, p.Repos[id])
+		}
+	}
+	return repos
+}
+
+// IsLocalOnly will determine whether the build root only has access to the
+// local repos in the profile, i.e. every image repo is removed.
+func (p *Profile) IsLocalOnly() bool {
+	if len(p.RemoveRepos) != 1 || p.RemoveRepos[0] != "*" {
+		return false
+	}
+	for _, repo := range p.EnabledRepos() {
+		if !repo.Local {
+			return false
+		}
+	}
+	return true
+}
+
+// HasRemoteRepos will determine whether the profile adds any repo that isn't
+// local, whose contents can only be known inside the build root.
+func (p *Profile) HasRemoteRepos() bool {
+	for _, repo := range p.EnabledRepos() {
+		if !repo.Local {
+			return true
+		}
+	}
+	return false
+}
+
+// KeepsImageRepo will determine whether the named repo of the backing image
+// remains available in the build root.
+func (p *Profile) KeepsImageRepo(name string) bool {
+	for _, r := range p.RemoveRepos {
+		if r == "*" || r == name {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,229 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MountInfoPath is where the kernel lists the mounts of our namespace
+const MountInfoPath = "/proc/self/mountinfo"
+
+// A RecoveryPlan lists everything left behind by operations that did not get
+// to clean up after themselves, i.e. because solbuild crashed or was killed.
+type RecoveryPlan struct {
+	Mounts []string // Mount points to unmount, in the order they are unmounted
+	Locks  []string // Lockfiles whose owner has gone away
+}
+
+// unescapeMountPath will decode the octal escapes used by the kernel for
+// whitespace and backslashes in mount paths.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+	var out []byte
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if n, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				out = append(out, byte(n))
+				i += 3
+				continue
+			}
+		}
+		out = append(out, path[i])
+	}
+	return string(out)
+}
+
+// ParseMountInfo will return the mount points listed in the mountinfo format,
+// in the order in which they were mounted.
+func ParseMountInfo(r io.Reader) ([]string, error) {
+	var mounts []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mounts = append(mounts, unescapeMountPath(fields[4]))
+	}
+	return mounts, sc.Err()
+}
+
+// mountLockPath will return the lockfile guarding the given solbuild mount,
+// or an empty string if the path isn't one that solbuild mounts. Only the
+// exact layout used by builds and image updates is recognised, so that we
+// never mistake somebody else's mount for one of ours.
+func mountLockPath(path string) string {
+	if rel, err := filepath.Rel(OverlayRootDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		// i.e. /var/cache/solbuild/unstable-x86_64/nano/union/proc
+		parts := strings.Split(rel, string(os.PathSeparator))
+		if len(parts) < 2 {
+			return ""
+		}
+		// The tmpfs is mounted on the base directory itself
+		if len(parts) > 2 && parts[2] != "img" && parts[2] != "union" {
+			return ""
+		}
+		if len(parts) > 3 && parts[2] == "img" {
+			return ""
+		}
+		return filepath.Join(OverlayRootDir, parts[0], parts[1]) + ".lock"
+	}
+	if rel, err := filepath.Rel(ImageRootsDir, path); err == nil && !strings.HasPrefix(rel, "..") {
+		// i.e. /var/lib/solbuild/roots/unstable-x86_64/proc
+		parts := strings.Split(rel, string(os.PathSeparator))
+		if !IsValidImage(parts[0]) {
+			return ""
+		}
+		return filepath.Join(ImagesDir, parts[0]) + ".lock"
+	}
+	return ""
+}
+
+// isStaleLock will determine whether the lockfile is missing or its owner
+// has gone away. A lockfile that has only just been created isn't stale, as
+// its owner is still starting up.
+func isStaleLock(path string) bool {
+	if !PathExists(path) {
+		return true
+	}
+	lock, err := ReadLockFile(path)
+	if err != nil {
+		return false
+	}
+	if isStartingLock(path, lock.GetOwnerPID()) {
+		return false
+	}
+	return lock.IsDead()
+}
+
+// findLockFiles returns all lockfiles for images and overlays
+func findLockFiles() ([]string, error) {
+	var locks []string
+	for _, pattern := range []string{
+		filepath.Join(ImagesDir, "*.lock"),
+		filepath.Join(OverlayRootDir, "*", "*.lock"),
+	} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		locks = append(locks, matches...)
+	}
+	return locks, nil
+}
+
+// PlanRecovery will find all solbuild mounts and lockfiles whose owner is no
+// longer running. Anything belonging to an active operation is left alone.
+func PlanRecovery() (*RecoveryPlan, error) {
+	fi, err := os.Open(MountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+
+	mounts, err := ParseMountInfo(fi)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &RecoveryPlan{}
+
+	// Unmount in the reverse order that things were mounted
+	for i := len(mounts) - 1; i >= 0; i-- {
+		lockPath := mountLockPath(mounts[i])
+		if lockPath == "" || !isStaleLock(lockPath) {
+			continue
+		}
+		plan.Mounts = append(plan.Mounts, mounts[i])
+	}
+
+	locks, err := findLockFiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, l := range locks {
+		if isStaleLock(l) {
+			plan.Locks = append(plan.Locks, l)
+		}
+	}
+	return plan, nil
+}
+
+// IsEmpty will determine if there is anything to recover
+func (r *RecoveryPlan) IsEmpty() bool {
+	return len(r.Mounts) == 0 && len(r.Locks) == 0
+}
+
+// Execute will kill any processes left running in the stale mounts, unmount
+// them and remove the dead lockfiles. Loop devices set up for the images are
+// released by the kernel once they are unmounted.
+func (r *RecoveryPlan) Execute() error {
+	var failed []string
+
+	for _, m := range r.Mounts {
+		MurderDeathKill(m)
+	}
+
+	for _, m := range r.Mounts {
+		log.WithFields(log.Fields{
+			"path": m,
+		}).Info("Unmounting stale mount")
+		if err := syscall.Unmount(m, 0); err != nil {
+			log.WithFields(log.Fields{
+				"path":  m,
+				"error": err,
+			}).Warning("Mount is busy, detaching it instead")
+			if err := syscall.Unmount(m, syscall.MNT_DETACH); err != nil {
+				log.WithFields(log.Fields{
+					"path":  m,
+					"error": err,
+				}).Error("Failed to unmount")
+				failed = append(failed, m)
+			}
+		}
+	}
+
+	for _, l := range r.Locks {
+		log.WithFields(log.Fields{
+			"path": l,
+		}).Info("Removing dead lockfile")
+		if err := os.Remove(l); err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"path":  l,
+				"error": err,
+			}).Error("Failed to remove lockfile")
+			failed = append(failed, l)
+		}
+		os.Remove(StatusPath(l))
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to recover: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
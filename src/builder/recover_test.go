@@ -0,0 +1,61 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"strings"
+	"testing"
+)
+
+const testMountInfo = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+60 22 7:0 / /var/cache/solbuild/unstable-x86_64/nano/img ro shared:30 - ext4 /dev/loop0 ro
+61 22 0:50 / /var/cache/solbuild/unstable-x86_64/nano/union rw shared:31 - overlay overlay rw
+62 61 0:4 / /var/cache/solbuild/unstable-x86_64/nano/union/proc rw shared:32 - proc proc rw
+63 22 7:1 / /var/lib/solbuild/roots/main\040x86_64 rw shared:33 - ext4 /dev/loop1 rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := ParseMountInfo(strings.NewReader(testMountInfo))
+	if err != nil {
+		t.Fatalf("Failed to parse mountinfo: %v", err)
+	}
+	if len(mounts) != 5 {
+		t.Fatalf("Expected 5 mounts, got %d: %v", len(mounts), mounts)
+	}
+	if mounts[4] != "/var/lib/solbuild/roots/main x86_64" {
+		t.Fatalf("Escaped mount point not decoded: %s", mounts[4])
+	}
+
+	locks := map[string]string{
+		"/": "",
+		"/var/cache/solbuild/unstable-x86_64/nano/union/proc": "/var/cache/solbuild/unstable-x86_64/nano.lock",
+		"/var/cache/solbuild/unstable-x86_64/nano/img":        "/var/cache/solbuild/unstable-x86_64/nano.lock",
+		"/var/cache/solbuild/unstable-x86_64/nano":            "/var/cache/solbuild/unstable-x86_64/nano.lock",
+		"/var/cache/solbuild/unstable-x86_64/nano/img/proc":   "",
+		"/var/cache/solbuild/unstable-x86_64/nano/other":      "",
+		"/var/cache/solbuild/unstable-x86_64":                 "",
+		"/var/lib/solbuild/roots/unstable-x86_64/proc":        "/var/lib/solbuild/images/unstable-x86_64.lock",
+		"/var/lib/solbuild/roots/main x86_64":                 "",
+		"/var/lib/solbuild/roots/.unstable-x86_64-123":        "",
+		"/var/lib/solbuild/roots":                             "",
+	}
+	for mount, expected := range locks {
+		if l := mountLockPath(mount); l != expected {
+			t.Fatalf("Wrong lockfile for %s: '%s' vs expected '%s'", mount, l, expected)
+		}
+	}
+}
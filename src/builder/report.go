@@ -0,0 +1,217 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// BuildReportSuffix is appended to the package name, version and release
+	// to form the name of the build report.
+	BuildReportSuffix = ".report.json"
+
+	// PhaseMount is the first phase of every build
+	PhaseMount = "mount"
+
+	// PhaseRefreshImage is the phase in which a stale image is updated
+	// before the build, when the image age policy requires it.
+	PhaseRefreshImage = "refresh-image"
+)
+
+// phaseAfter maps each build event to the name of the phase that it begins
+var phaseAfter = map[EventType]string{
+	EventOverlayMounted:      "sources",
+	EventSourcesFetched:      "repos",
+	EventReposConfigured:     "upgrade",
+	EventBaseUpgraded:        "components",
+	EventComponentsInstalled: "dependencies",
+	EventDepsInstalled:       "prepare",
+	EventBuildStarted:        "compile",
+	EventBuildFinished:       "collect",
+}
+
+// PhaseAfter returns the name of the build phase that begins with the given
+// event, or an empty string if no phase follows it.
+func PhaseAfter(t EventType) string {
+	return phaseAfter[t]
+}
+
+// A PhaseReport records the resources used by a single phase of the build
+type PhaseReport struct {
+	Name       string    `json:"name"`
+	Started    time.Time `json:"started"`
+	Duration   float64   `json:"duration_seconds"`
+	UserCPU    float64   `json:"user_cpu_seconds"`
+	SystemCPU  float64   `json:"system_cpu_seconds"`
+	Incomplete bool      `json:"incomplete,omitempty"` // Phase did not finish
+}
+
+// A BuildReport records the wall time and CPU time of each phase of a build,
+// along with the memory usage of the processes run by the build.
+//
+// CPU time and MaxProcessRSS are only accounted for processes that have been
+// waited for, i.e. the processes run in the build root and their children.
+// MaxProcessRSS is that of the largest single process, not of the build as a
+// whole. The peak memory usage of the whole build is only known when it runs
+// in a cgroup, i.e. when resource limits are set.
+type BuildReport struct {
+	Package  string    `json:"package"`
+	Version  string    `json:"version"`
+	Release  int       `json:"release"`
+	Profile  string    `json:"profile"`
+	Commit   string    `json:"commit,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+
+	FailedPhase string `json:"failed_phase,omitempty"` // Phase in progress when the build failed
+	TimedOut    bool   `json:"timed_out,omitempty"`    // Whether the build was stopped for taking too long
+
+	Duration  float64 `json:"duration_seconds"`
+	UserCPU   float64 `json:"user_cpu_seconds"`
+	SystemCPU float64 `json:"system_cpu_seconds"`
+
+	MaxProcessRSS int64 `json:"max_process_rss_kb"`       // Largest single process
+	MemoryPeak    int64 `json:"memory_peak_kb,omitempty"` // Whole build, from its cgroup
+
+	Phases []*PhaseReport `json:"phases"`
+
+	Image *ImageMetadata `json:"image,omitempty"` // Backing image the package was built with
+
+	lock     sync.Mutex
+	current  *PhaseReport
+	lastUser time.Duration // Children user CPU time when the phase began
+	lastSys  time.Duration // Children system CPU time when the phase began
+}
+
+// NewBuildReport will return a report with the mount phase already started
+func NewBuildReport() *BuildReport {
+	r := &BuildReport{Started: time.Now().UTC()}
+	r.lastUser, r.lastSys, _ = childrenUsage()
+	r.current = &PhaseReport{Name: PhaseMount, Started: r.Started}
+	return r
+}
+
+// childrenUsage returns the CPU time used by all waited for children so far,
+// and the maximum resident set size of any one of them in kilobytes.
+func childrenUsage() (user time.Duration, sys time.Duration, maxRSS int64) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_CHILDREN, &ru); err != nil {
+		return 0, 0, 0
+	}
+	return time.Duration(ru.Utime.Nano()), time.Duration(ru.Stime.Nano()), int64(ru.Maxrss)
+}
+
+// endPhase will close the current phase, if any, at the given time
+func (r *BuildReport) endPhase(when time.Time, incomplete bool) {
+	if r.current == nil {
+		return
+	}
+	user, sys, maxRSS := childrenUsage()
+	r.current.Duration = when.Sub(r.current.Started).Seconds()
+	r.current.UserCPU = (user - r.lastUser).Seconds()
+	r.current.SystemCPU = (sys - r.lastSys).Seconds()
+	r.current.Incomplete = incomplete
+	r.Phases = append(r.Phases, r.current)
+
+	r.UserCPU += r.current.UserCPU
+	r.SystemCPU += r.current.SystemCPU
+	if maxRSS > r.MaxProcessRSS {
+		r.MaxProcessRSS = maxRSS
+	}
+	r.lastUser, r.lastSys = user, sys
+	r.current = nil
+}
+
+// HandleEvent will end the current phase and begin the next one
+func (r *BuildReport) HandleEvent(e *Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Package = e.Package
+	r.Version = e.Version
+	r.Release = e.Release
+	r.Profile = e.Profile
+	r.Commit = e.Commit
+
+	switch e.Type {
+	case EventBuildFailed:
+		if r.current != nil {
+			r.FailedPhase = r.current.Name
+		}
+		r.endPhase(e.Time, true)
+		r.Error = e.Error
+		r.TimedOut = e.Error == ErrTimeout.Error()
+		return
+	case EventArtifactsCollected:
+		r.Success = true
+	}
+
+	r.endPhase(e.Time, false)
+	if next := PhaseAfter(e.Type); next != "" {
+		r.current = &PhaseReport{Name: next, Started: e.Time}
+	}
+}
+
+// SetImage will record the backing image used for the build
+func (r *BuildReport) SetImage(meta *ImageMetadata) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.Image = meta
+}
+
+// SetMemoryPeak will record the peak memory usage of the whole build, in
+// bytes.
+func (r *BuildReport) SetMemoryPeak(peak int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.MemoryPeak = peak / 1024
+}
+
+// Write will finish the report and store it as JSON at the given path
+func (r *BuildReport) Write(path string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.Finished = time.Now().UTC()
+	r.endPhase(r.Finished, true)
+	r.Duration = r.Finished.Sub(r.Started).Seconds()
+
+	blob, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(blob, '\n'), 00644)
+}
+
+// CollectReport will write the build report and copy it back to the users
+// current directory as $name-$version-$release.report.json
+func (p *Package) CollectReport(r *BuildReport, overlay *Overlay, usr *UserInfo) error {
+	path := overlay.BaseDir + BuildReportSuffix
+	if err := r.Write(path); err != nil {
+		return err
+	}
+	reportFile := fmt.Sprintf("%s-%s-%d%s", p.Name, p.Version, p.Release, BuildReportSuffix)
+	return collectFile(path, reportFile, usr)
+}
@@ -158,17 +158,5 @@ func (p *Package) ConfigureRepos(notif PidNotifier, o *Overlay, pkgManager *Eopk
 		return err
 	}
 
-	var addRepos []*Repo
-
-	if (len(profile.AddRepos) == 1 && profile.AddRepos[0] == "*") || len(profile.AddRepos) == 0 {
-		for _, repo := range profile.Repos {
-			addRepos = append(addRepos, repo)
-		}
-	} else {
-		for _, id := range profile.AddRepos {
-			addRepos = append(addRepos, profile.Repos[id])
-		}
-	}
-
-	return p.addRepos(notif, o, pkgManager, addRepos)
+	return p.addRepos(notif, o, pkgManager, profile.EnabledRepos())
 }
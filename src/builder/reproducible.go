@@ -0,0 +1,288 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// InstallTarball is the payload within each .eopkg archive
+	InstallTarball = "install.tar.xz"
+)
+
+// A Difference describes a single way in which the results of two builds
+// of the same package differ.
+type Difference struct {
+	Archive string // Name of the .eopkg file
+	File    string // File within the archive or its payload, if applicable
+	Reason  string // What differs
+}
+
+// String returns a human readable form of the difference
+func (d *Difference) String() string {
+	if d.File == "" {
+		return fmt.Sprintf("%s: %s", d.Archive, d.Reason)
+	}
+	return fmt.Sprintf("%s: %s: %s", d.Archive, d.File, d.Reason)
+}
+
+// payloadEntry is the information we compare for each file in the payload
+type payloadEntry struct {
+	header *tar.Header
+	sum    string
+}
+
+// CompareBuildDirs will compare all .eopkg files in the two directories, as
+// produced by two builds of the same package.
+func CompareBuildDirs(a, b string) ([]*Difference, error) {
+	filesA, err := filepath.Glob(filepath.Join(a, "*.eopkg"))
+	if err != nil {
+		return nil, err
+	}
+	filesB, err := filepath.Glob(filepath.Join(b, "*.eopkg"))
+	if err != nil {
+		return nil, err
+	}
+
+	namesB := make(map[string]bool)
+	for _, f := range filesB {
+		namesB[filepath.Base(f)] = true
+	}
+
+	var diffs []*Difference
+	for _, f := range filesA {
+		name := filepath.Base(f)
+		if !namesB[name] {
+			diffs = append(diffs, &Difference{Archive: name, Reason: "only produced by the first build"})
+			continue
+		}
+		delete(namesB, name)
+		d, err := CompareEopkg(f, filepath.Join(b, name))
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, d...)
+	}
+	for name := range namesB {
+		diffs = append(diffs, &Difference{Archive: name, Reason: "only produced by the second build"})
+	}
+
+	sortDifferences(diffs)
+	return diffs, nil
+}
+
+// CompareEopkg will compare the two .eopkg archives, member by member. The
+// payload of each archive is unpacked and compared file by file.
+func CompareEopkg(a, b string) ([]*Difference, error) {
+	name := filepath.Base(a)
+
+	za, err := zip.OpenReader(a)
+	if err != nil {
+		return nil, err
+	}
+	defer za.Close()
+
+	zb, err := zip.OpenReader(b)
+	if err != nil {
+		return nil, err
+	}
+	defer zb.Close()
+
+	membersB := make(map[string]*zip.File)
+	for _, f := range zb.File {
+		membersB[f.Name] = f
+	}
+
+	var diffs []*Difference
+	for _, fa := range za.File {
+		fb, ok := membersB[fa.Name]
+		if !ok {
+			diffs = append(diffs, &Difference{Archive: name, File: fa.Name, Reason: "only in the first build"})
+			continue
+		}
+		delete(membersB, fa.Name)
+
+		if fa.Name == InstallTarball {
+			d, err := comparePayloads(name, fa, fb)
+			if err != nil {
+				return nil, err
+			}
+			diffs = append(diffs, d...)
+			continue
+		}
+
+		sumA, err := zipMemberSha256sum(fa)
+		if err != nil {
+			return nil, err
+		}
+		sumB, err := zipMemberSha256sum(fb)
+		if err != nil {
+			return nil, err
+		}
+		if sumA != sumB {
+			diffs = append(diffs, &Difference{Archive: name, File: fa.Name, Reason: "contents differ"})
+		}
+	}
+	for member := range membersB {
+		diffs = append(diffs, &Difference{Archive: name, File: member, Reason: "only in the second build"})
+	}
+
+	sortDifferences(diffs)
+	return diffs, nil
+}
+
+// comparePayloads will compare each file within the install tarballs
+func comparePayloads(name string, a, b *zip.File) ([]*Difference, error) {
+	entriesA, err := readPayload(a)
+	if err != nil {
+		return nil, err
+	}
+	entriesB, err := readPayload(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var diffs []*Difference
+	for path, ea := range entriesA {
+		eb, ok := entriesB[path]
+		if !ok {
+			diffs = append(diffs, &Difference{Archive: name, File: path, Reason: "only in the first build"})
+			continue
+		}
+		for _, reason := range comparePayloadEntries(ea, eb) {
+			diffs = append(diffs, &Difference{Archive: name, File: path, Reason: reason})
+		}
+	}
+	for path := range entriesB {
+		if _, ok := entriesA[path]; !ok {
+			diffs = append(diffs, &Difference{Archive: name, File: path, Reason: "only in the second build"})
+		}
+	}
+	return diffs, nil
+}
+
+// comparePayloadEntries returns each way in which the two files differ
+func comparePayloadEntries(a, b *payloadEntry) []string {
+	var reasons []string
+	ha, hb := a.header, b.header
+
+	if ha.Typeflag != hb.Typeflag {
+		reasons = append(reasons, "file type differs")
+	}
+	if ha.Mode != hb.Mode {
+		reasons = append(reasons, fmt.Sprintf("mode differs (%#o vs %#o)", ha.Mode, hb.Mode))
+	}
+	if ha.Uid != hb.Uid || ha.Gid != hb.Gid {
+		reasons = append(reasons, fmt.Sprintf("ownership differs (%d:%d vs %d:%d)", ha.Uid, ha.Gid, hb.Uid, hb.Gid))
+	}
+	if ha.Linkname != hb.Linkname {
+		reasons = append(reasons, fmt.Sprintf("link target differs (%s vs %s)", ha.Linkname, hb.Linkname))
+	}
+	if !ha.ModTime.Equal(hb.ModTime) {
+		reasons = append(reasons, "modification time differs")
+	}
+	if a.sum != b.sum {
+		reasons = append(reasons, "contents differ")
+	}
+	return reasons
+}
+
+// readPayload will decompress the install tarball with xz, returning each
+// entry within it, keyed by path.
+func readPayload(f *zip.File) (map[string]*payloadEntry, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	c := exec.Command("xz", "-dc")
+	c.Stdin = rc
+	out, err := c.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*payloadEntry)
+	tr := tar.NewReader(out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.Process.Kill()
+			c.Wait()
+			return nil, err
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, tr); err != nil {
+			c.Process.Kill()
+			c.Wait()
+			return nil, err
+		}
+		entries[filepath.Clean(hdr.Name)] = &payloadEntry{
+			header: hdr,
+			sum:    hex.EncodeToString(h.Sum(nil)),
+		}
+	}
+
+	if err := c.Wait(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// zipMemberSha256sum will return the sha256sum of the uncompressed member
+func zipMemberSha256sum(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sortDifferences keeps the report stable between runs
+func sortDifferences(diffs []*Difference) {
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Archive != diffs[j].Archive {
+			return diffs[i].Archive < diffs[j].Archive
+		}
+		if diffs[i].File != diffs[j].File {
+			return diffs[i].File < diffs[j].File
+		}
+		return diffs[i].Reason < diffs[j].Reason
+	})
+}
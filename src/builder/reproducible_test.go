@@ -0,0 +1,125 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestEopkg creates a minimal .eopkg with the given payload files
+func writeTestEopkg(t *testing.T, path, metadata string, payload map[string]string) {
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for name, content := range payload {
+		hdr := &tar.Header{
+			Name:    name,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: time.Unix(1480000000, 0),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Failed to write tar header: %v", err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+
+	c := exec.Command("xz", "-c")
+	c.Stdin = &tarBuf
+	xz, err := c.Output()
+	if err != nil {
+		t.Fatalf("Failed to compress payload: %v", err)
+	}
+
+	fd, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Failed to create archive: %v", err)
+	}
+	defer fd.Close()
+	zw := zip.NewWriter(fd)
+	w, _ := zw.Create("metadata.xml")
+	w.Write([]byte(metadata))
+	w, _ = zw.Create(InstallTarball)
+	w.Write(xz)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to write archive: %v", err)
+	}
+}
+
+func TestCompareBuildDirs(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz is not available")
+	}
+
+	tmp, err := ioutil.TempDir("", "solbuild-test")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	a := filepath.Join(tmp, "a")
+	b := filepath.Join(tmp, "b")
+	os.Mkdir(a, 00755)
+	os.Mkdir(b, 00755)
+
+	name := "nano-2.7.1-64-1-x86_64.eopkg"
+	writeTestEopkg(t, filepath.Join(a, name), "<meta/>", map[string]string{
+		"usr/bin/nano":       "binary",
+		"usr/share/nano/doc": "doc",
+	})
+	writeTestEopkg(t, filepath.Join(b, name), "<meta/>", map[string]string{
+		"usr/bin/nano":       "binary",
+		"usr/share/nano/doc": "different doc",
+	})
+
+	diffs, err := CompareBuildDirs(a, a)
+	if err != nil {
+		t.Fatalf("Failed to compare identical builds: %v", err)
+	}
+	if len(diffs) != 0 {
+		t.Fatalf("Identical builds should not differ: %v", diffs)
+	}
+
+	diffs, err = CompareBuildDirs(a, b)
+	if err != nil {
+		t.Fatalf("Failed to compare builds: %v", err)
+	}
+	if len(diffs) != 1 {
+		t.Fatalf("Expected 1 difference, got %d: %v", len(diffs), diffs)
+	}
+	if diffs[0].File != "usr/share/nano/doc" || diffs[0].Reason != "contents differ" {
+		t.Fatalf("Wrong difference reported: %v", diffs[0])
+	}
+
+	// Packages only produced by one build must be reported
+	writeTestEopkg(t, filepath.Join(b, "nano-devel-2.7.1-64-1-x86_64.eopkg"), "<meta/>", nil)
+	diffs, err = CompareBuildDirs(a, b)
+	if err != nil {
+		t.Fatalf("Failed to compare builds: %v", err)
+	}
+	if len(diffs) != 2 || diffs[1].Reason != "only produced by the second build" {
+		t.Fatalf("Missing package not reported: %v", diffs)
+	}
+}
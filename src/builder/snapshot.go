@@ -0,0 +1,422 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// ImageSnapshotsDir is the directory, relative to the images, in which
+	// previous generations of each image are kept.
+	ImageSnapshotsDir = "snapshots"
+
+	// ImageUndoName is the name of the snapshot of the image replaced by the
+	// last rollback.
+	ImageUndoName = "undo"
+
+	// DefaultImageSnapshots is how many previous generations of each image
+	// are kept unless configured otherwise.
+	DefaultImageSnapshots = 3
+
+	// ficlone is the FICLONE ioctl, to share the extents of one file with another
+	ficlone = 0x40049409
+
+	// imageCopyBlock is the size of the blocks copied when the image can't
+	// be cloned. All-zero blocks are skipped to keep the copy sparse.
+	imageCopyBlock = 64 * 1024
+)
+
+var (
+	// ErrNoSnapshots is returned when rolling back an image with no snapshots
+	ErrNoSnapshots = errors.New("The image has no snapshots")
+
+	// ErrNoSuchSnapshot is returned when rolling back to an unknown generation
+	ErrNoSuchSnapshot = errors.New("The image has no snapshot of that generation")
+
+	// ErrNoUndo is returned when undoing a rollback that never happened
+	ErrNoUndo = errors.New("The image has no rollback to undo")
+)
+
+// An ImageSnapshot is a previous generation of a backing image
+type ImageSnapshot struct {
+	Generation int       // Increases with each snapshot of the image
+	Path       string    // Path of the snapshot image file
+	Created    time.Time // When the snapshot was taken
+	Size       int64     // Space used on disk, in bytes
+}
+
+// newImageSnapshot will return the snapshot stored at the given path
+func newImageSnapshot(path string) (*ImageSnapshot, error) {
+	gen, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ImageSuffix))
+	if err != nil {
+		return nil, err
+	}
+	return statSnapshot(path, gen)
+}
+
+// statSnapshot will return the snapshot at path with the given generation
+func statSnapshot(path string, gen int) (*ImageSnapshot, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &ImageSnapshot{
+		Generation: gen,
+		Path:       path,
+		Created:    st.ModTime(),
+		Size:       st.Size(),
+	}
+	if sys, ok := st.Sys().(*syscall.Stat_t); ok {
+		s.Size = sys.Blocks * 512
+	}
+	return s, nil
+}
+
+// MetadataPath returns the path of the metadata of the image at the time of
+// the snapshot.
+func (s *ImageSnapshot) MetadataPath() string {
+	return strings.TrimSuffix(s.Path, ImageSuffix) + ImageMetadataSuffix
+}
+
+// SnapshotDir returns the directory holding the snapshots of the image
+func (b *BackingImage) SnapshotDir() string {
+	return filepath.Join(filepath.Dir(b.ImagePath), ImageSnapshotsDir, b.Name)
+}
+
+// undoPath returns the path of the image replaced by the last rollback
+func (b *BackingImage) undoPath() string {
+	return filepath.Join(b.SnapshotDir(), ImageUndoName+ImageSuffix)
+}
+
+// UndoSnapshot returns the image replaced by the last rollback, or nil if
+// there is none. Its generation is always 0.
+func (b *BackingImage) UndoSnapshot() (*ImageSnapshot, error) {
+	s, err := statSnapshot(b.undoPath(), 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return s, err
+}
+
+// Snapshots returns the snapshots of the image, newest first
+func (b *BackingImage) Snapshots() ([]*ImageSnapshot, error) {
+	paths, err := filepath.Glob(filepath.Join(b.SnapshotDir(), "*"+ImageSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*ImageSnapshot
+	for _, path := range paths {
+		if path == b.undoPath() {
+			continue
+		}
+		s, err := newImageSnapshot(path)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"path":  path,
+				"error": err,
+			}).Warning("Ignoring invalid snapshot")
+			continue
+		}
+		snapshots = append(snapshots, s)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Generation > snapshots[j].Generation
+	})
+	return snapshots, nil
+}
+
+// Snapshot will keep the image as its next generation, and then remove all
+// but the newest keep generations. The image is hard linked into place where
+// possible, so it must only ever be replaced and never modified afterwards.
+func (b *BackingImage) Snapshot(keep int) (*ImageSnapshot, error) {
+	snapshots, err := b.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	gen := 1
+	if len(snapshots) > 0 {
+		gen = snapshots[0].Generation + 1
+	}
+	if err := os.MkdirAll(b.SnapshotDir(), 00755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(b.SnapshotDir(), fmt.Sprintf("%d%s", gen, ImageSuffix))
+
+	log.WithFields(log.Fields{
+		"image":      b.Name,
+		"generation": gen,
+	}).Info("Taking snapshot of image")
+	if err := os.Link(b.ImagePath, path); err != nil {
+		log.WithFields(log.Fields{
+			"image": b.ImagePath,
+			"error": err,
+		}).Debug("Cannot link image, falling back to a copy")
+		if err := CopyImage(b.ImagePath, path); err != nil {
+			return nil, err
+		}
+	}
+	snap, err := newImageSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	if meta, err := b.ReadMetadata(); err == nil {
+		if err := writeImageMetadata(snap.MetadataPath(), meta); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := b.PruneSnapshots(keep); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// PruneSnapshots will remove all but the newest keep snapshots of the image
+func (b *BackingImage) PruneSnapshots(keep int) error {
+	snapshots, err := b.Snapshots()
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(snapshots); i++ {
+		log.WithFields(log.Fields{
+			"image":      b.Name,
+			"generation": snapshots[i].Generation,
+		}).Debug("Removing old snapshot")
+		if err := removeSnapshot(snapshots[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rollback will replace the image with the snapshot of the given generation,
+// or the newest snapshot if generation is 0. The snapshot is consumed by the
+// rollback along with any newer generations, so rolling back again steps back
+// a further generation. The replaced image is kept so that the rollback may
+// be undone.
+func (b *BackingImage) Rollback(generation int) (*ImageSnapshot, error) {
+	snapshots, err := b.Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) < 1 {
+		return nil, ErrNoSnapshots
+	}
+	snap := snapshots[0]
+	if generation > 0 {
+		snap = nil
+		for _, s := range snapshots {
+			if s.Generation == generation {
+				snap = s
+				break
+			}
+		}
+		if snap == nil {
+			return nil, ErrNoSuchSnapshot
+		}
+	}
+	if err := b.saveUndo(); err != nil {
+		log.WithFields(log.Fields{
+			"image": b.Name,
+			"error": err,
+		}).Error("Failed to keep the image before rollback")
+		return nil, err
+	}
+	log.WithFields(log.Fields{
+		"image":      b.Name,
+		"generation": snap.Generation,
+	}).Info("Rolling back image")
+	if err := b.restore(snap); err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		if s.Generation <= snap.Generation {
+			continue
+		}
+		log.WithFields(log.Fields{
+			"image":      b.Name,
+			"generation": s.Generation,
+		}).Debug("Removing snapshot newer than rollback")
+		if err := removeSnapshot(s); err != nil {
+			return nil, err
+		}
+	}
+	return snap, nil
+}
+
+// Undo will restore the image replaced by the last rollback. The image it
+// replaces is kept as the next generation when KeepSnapshots is set, so the
+// rollback may be repeated.
+func (b *BackingImage) Undo() error {
+	undo, err := b.UndoSnapshot()
+	if err != nil {
+		return err
+	}
+	if undo == nil {
+		return ErrNoUndo
+	}
+	if b.KeepSnapshots > 0 && PathExists(b.ImagePath) {
+		if _, err := b.Snapshot(b.KeepSnapshots); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"image": b.Name,
+	}).Info("Undoing rollback of image")
+	return b.restore(undo)
+}
+
+// saveUndo will keep the image as the one replaced by the last rollback
+func (b *BackingImage) saveUndo() error {
+	undo := &ImageSnapshot{Path: b.undoPath()}
+	if err := removeSnapshot(undo); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if !PathExists(b.ImagePath) {
+		return nil
+	}
+	if err := os.MkdirAll(b.SnapshotDir(), 00755); err != nil {
+		return err
+	}
+	if err := os.Link(b.ImagePath, undo.Path); err != nil {
+		if err := CopyImage(b.ImagePath, undo.Path); err != nil {
+			return err
+		}
+	}
+	if meta, err := b.ReadMetadata(); err == nil {
+		return writeImageMetadata(undo.MetadataPath(), meta)
+	}
+	return nil
+}
+
+// restore will move the snapshot and its metadata into place as the image
+func (b *BackingImage) restore(snap *ImageSnapshot) error {
+	if err := os.Rename(snap.Path, b.ImagePath); err != nil {
+		return err
+	}
+	// Without metadata, the age is taken from the image itself
+	err := os.Rename(snap.MetadataPath(), b.MetadataPath())
+	if os.IsNotExist(err) {
+		err = os.Remove(b.MetadataPath())
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// removeSnapshot will delete the snapshot along with any metadata
+func removeSnapshot(s *ImageSnapshot) error {
+	if err := os.Remove(s.Path); err != nil {
+		return err
+	}
+	if err := os.Remove(s.MetadataPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// cloneFile will share the extents of the source with the target, on
+// filesystems that support reflinks.
+func cloneFile(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// sparseCopy will copy the source to the target, leaving holes in place of
+// zeroed blocks.
+func sparseCopy(dst, src *os.File) error {
+	st, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, imageCopyBlock)
+	zero := make([]byte, imageCopyBlock)
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if bytes.Equal(buf[:n], zero[:n]) {
+				_, err = dst.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = dst.Write(buf[:n])
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Account for any trailing hole
+	return dst.Truncate(st.Size())
+}
+
+// CopyImage will copy the image file at src to dst, as a reflink where the
+// filesystem supports it, and as a sparse copy otherwise. The copy is only
+// stored at dst once it is complete.
+func CopyImage(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := cloneFile(tmp, in); err != nil {
+		log.WithFields(log.Fields{
+			"image": src,
+			"error": err,
+		}).Debug("Cannot clone image, falling back to a copy")
+		if err := sparseCopy(tmp, in); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Chmod(00644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
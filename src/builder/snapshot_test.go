@@ -0,0 +1,137 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestImage replaces the image as an update would, leaving any snapshot
+// linked to the previous image intact
+func writeTestImage(t *testing.T, path, content string) {
+	tmp := path + ImageStagingSuffix
+	if err := ioutil.WriteFile(tmp, []byte(content), 00644); err != nil {
+		t.Fatalf("Failed to write image: %v", err)
+	}
+	// Trailing hole must survive the copy
+	if err := os.Truncate(tmp, 4*imageCopyBlock); err != nil {
+		t.Fatalf("Failed to extend image: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("Failed to replace image: %v", err)
+	}
+}
+
+func readTestImage(t *testing.T, path string) string {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read image: %v", err)
+	}
+	if len(blob) != 4*imageCopyBlock {
+		t.Fatalf("Image has the wrong size: %d", len(blob))
+	}
+	return string(bytes.TrimRight(blob, "\x00"))
+}
+
+func TestImageSnapshots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-snapshot")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	b := &BackingImage{Name: "test", ImagePath: filepath.Join(dir, "test.img")}
+	if _, err := b.Rollback(0); err != ErrNoSnapshots {
+		t.Fatalf("Rollback without snapshots should fail, got: %v", err)
+	}
+
+	for _, content := range []string{"one", "two", "three"} {
+		writeTestImage(t, b.ImagePath, content)
+		if _, err := b.Snapshot(2); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+	}
+	writeTestImage(t, b.ImagePath, "four")
+
+	snapshots, err := b.Snapshots()
+	if err != nil {
+		t.Fatalf("Failed to list snapshots: %v", err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Generation != 3 || snapshots[1].Generation != 2 {
+		t.Fatalf("Should keep the newest two generations, got: %v", snapshots)
+	}
+	if got := readTestImage(t, snapshots[1].Path); got != "two" {
+		t.Fatalf("Snapshot has the wrong content: %s", got)
+	}
+
+	if _, err := b.Rollback(1); err != ErrNoSuchSnapshot {
+		t.Fatalf("Rollback to pruned generation should fail, got: %v", err)
+	}
+	snap, err := b.Rollback(0)
+	if err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+	if snap.Generation != 3 {
+		t.Fatalf("Should roll back to the newest generation, got: %d", snap.Generation)
+	}
+	if got := readTestImage(t, b.ImagePath); got != "three" {
+		t.Fatalf("Image has the wrong content after rollback: %s", got)
+	}
+	if snapshots, _ = b.Snapshots(); len(snapshots) != 1 {
+		t.Fatalf("Rollback should consume the snapshot")
+	}
+
+	b.KeepSnapshots = 2
+	if err := b.Undo(); err != nil {
+		t.Fatalf("Failed to undo rollback: %v", err)
+	}
+	if got := readTestImage(t, b.ImagePath); got != "four" {
+		t.Fatalf("Image has the wrong content after undo: %s", got)
+	}
+	if snapshots, _ = b.Snapshots(); len(snapshots) != 2 || snapshots[0].Generation != 3 {
+		t.Fatalf("Undo should keep the rolled back image as a snapshot, got: %v", snapshots)
+	}
+
+	if _, err := b.Rollback(2); err != nil {
+		t.Fatalf("Failed to roll back to generation 2: %v", err)
+	}
+	if got := readTestImage(t, b.ImagePath); got != "two" {
+		t.Fatalf("Image has the wrong content after rollback: %s", got)
+	}
+	if snapshots, _ = b.Snapshots(); len(snapshots) != 0 {
+		t.Fatalf("Rollback should remove newer generations, got: %v", snapshots)
+	}
+	undo, err := b.UndoSnapshot()
+	if err != nil || undo == nil {
+		t.Fatalf("Rollback should keep the replaced image: %v", err)
+	}
+	if got := readTestImage(t, undo.Path); got != "four" {
+		t.Fatalf("Undo snapshot has the wrong content: %s", got)
+	}
+
+	copied := filepath.Join(dir, "copy.img")
+	if err := CopyImage(b.ImagePath, copied); err != nil {
+		t.Fatalf("Failed to copy image: %v", err)
+	}
+	if got := readTestImage(t, copied); got != "two" {
+		t.Fatalf("Copy has the wrong content: %s", got)
+	}
+}
@@ -17,6 +17,7 @@
 package source
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
@@ -87,23 +88,35 @@ func (g *GitSource) message(str string) git.ErrorCode {
 	return 0
 }
 
-// CreateCallbacks will create the default git callbacks
-func (g *GitSource) CreateCallbacks() git.RemoteCallbacks {
+// CreateCallbacks will create the default git callbacks, which will abort
+// the transfer once the context is cancelled.
+func (g *GitSource) CreateCallbacks(ctx context.Context) git.RemoteCallbacks {
 	return git.RemoteCallbacks{
-		SidebandProgressCallback: g.message,
+		SidebandProgressCallback: func(str string) git.ErrorCode {
+			if ctx.Err() != nil {
+				return git.ErrUser
+			}
+			return g.message(str)
+		},
+		TransferProgressCallback: func(stats git.TransferProgress) git.ErrorCode {
+			if ctx.Err() != nil {
+				return git.ErrUser
+			}
+			return git.ErrOk
+		},
 	}
 }
 
 // Clone will set do a bare mirror clone of the remote repo to the local
 // cache.
-func (g *GitSource) Clone() error {
+func (g *GitSource) Clone(ctx context.Context) error {
 	// Attempt cloning
 	log.WithFields(log.Fields{
 		"uri": g.URI,
 	}).Debug("Cloning git source")
 
 	fetchOpts := &git.FetchOptions{
-		RemoteCallbacks: g.CreateCallbacks(),
+		RemoteCallbacks: g.CreateCallbacks(ctx),
 	}
 
 	_, err := git.Clone(g.URI, g.ClonePath, &git.CloneOptions{
@@ -126,7 +139,7 @@ func (g *GitSource) HasTag(repo *git.Repository, tagName string) bool {
 }
 
 // fetch will attempt
-func (g *GitSource) fetch(repo *git.Repository) error {
+func (g *GitSource) fetch(ctx context.Context, repo *git.Repository) error {
 	log.WithFields(log.Fields{
 		"uri": g.URI,
 	}).Info("Git fetching existing clone")
@@ -140,7 +153,7 @@ func (g *GitSource) fetch(repo *git.Repository) error {
 	}
 
 	fetchOpts := &git.FetchOptions{
-		RemoteCallbacks: g.CreateCallbacks(),
+		RemoteCallbacks: g.CreateCallbacks(ctx),
 	}
 
 	return remote.Fetch([]string{}, fetchOpts, "")
@@ -149,8 +162,12 @@ func (g *GitSource) fetch(repo *git.Repository) error {
 // GetCommitID will attempt to find the oid of the selected ref type
 func (g *GitSource) GetCommitID(repo *git.Repository) string {
 	oid := ""
-	// Attempt to find the branch
-	branch, err := repo.LookupBranch(g.Ref, git.BranchAll)
+	// Attempt to find the branch, as last fetched from the remote in
+	// preference to a local branch that is never updated
+	branch, err := repo.LookupBranch("origin/"+g.Ref, git.BranchRemote)
+	if err != nil {
+		branch, err = repo.LookupBranch(g.Ref, git.BranchAll)
+	}
 	if err == nil {
 		oid = branch.Target().String()
 		log.WithFields(log.Fields{
@@ -202,6 +219,20 @@ func (g *GitSource) GetCommitID(repo *git.Repository) string {
 	return obj.String()
 }
 
+// hasCommit will determine whether the ref is the full ID of a commit that
+// is already present in the repo
+func (g *GitSource) hasCommit(repo *git.Repository) bool {
+	if len(g.Ref) != 40 {
+		return false
+	}
+	oid, err := git.NewOid(g.Ref)
+	if err != nil {
+		return false
+	}
+	_, err = repo.Lookup(oid)
+	return err == nil
+}
+
 // GetHead will attempt to gain the OID for head
 func (g *GitSource) GetHead(repo *git.Repository) (string, error) {
 	head, err := repo.Head()
@@ -260,12 +291,16 @@ func (g *GitSource) submodules() error {
 
 // Fetch will attempt to download the git tree locally. If it already exists
 // then we'll make an attempt to update it.
-func (g *GitSource) Fetch() error {
+func (g *GitSource) Fetch(ctx context.Context) error {
 	hadRepo := true
 
 	// First things first, clone if necessary
 	if !PathExists(g.ClonePath) {
-		if err := g.Clone(); err != nil {
+		if err := g.Clone(ctx); err != nil {
+			if ctx.Err() != nil {
+				os.RemoveAll(g.ClonePath)
+				return ctx.Err()
+			}
 			log.WithFields(log.Fields{
 				"error": err,
 				"uri":   g.URI,
@@ -281,19 +316,17 @@ func (g *GitSource) Fetch() error {
 		return err
 	}
 
-	wantedCommit := g.GetCommitID(repo)
-	if wantedCommit == "" {
-		// Logic here being we just cloned it. Where is it?
-		if !hadRepo {
-			return fmt.Errorf("Cannot continue with git processing")
-		}
-		// So try to fetch it
-		if err := g.fetch(repo); err != nil {
+	// Branches and tags may have moved since the clone was last fetched, so
+	// only a commit we already have can be used without fetching
+	if hadRepo && !g.hasCommit(repo) {
+		if err := g.fetch(ctx, repo); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
-		// Re-establish the wanted commit
-		wantedCommit = g.GetCommitID(repo)
 	}
+	wantedCommit := g.GetCommitID(repo)
 
 	// Can't proceed now. Just doesn't exist
 	if wantedCommit == "" {
@@ -305,6 +338,10 @@ func (g *GitSource) Fetch() error {
 		return err
 	}
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
 	// Check out submodules
 	return g.submodules()
 }
@@ -17,6 +17,7 @@
 package source
 
 import (
+	"context"
 	"os"
 	"strings"
 )
@@ -54,7 +55,8 @@ type Source interface {
 	IsFetched() bool
 
 	// Fetch will attempt to fetch the this source locally and cache it.
-	Fetch() error
+	// The fetch is abandoned if the context is cancelled.
+	Fetch(ctx context.Context) error
 
 	// GetBindConfiguration should return a valid configuration specifying
 	// the origin on our local filesystem, and the target within the container.
@@ -17,6 +17,7 @@
 package source
 
 import (
+	"context"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/hex"
@@ -106,7 +107,7 @@ func (s *SimpleSource) IsFetched() bool {
 }
 
 // download utilises CURL to do all downloads
-func (s *SimpleSource) download(destination string) error {
+func (s *SimpleSource) download(ctx context.Context, destination string) error {
 	hnd := curl.EasyInit()
 	defer hnd.Cleanup()
 
@@ -131,6 +132,10 @@ func (s *SimpleSource) download(destination string) error {
 		return true
 	}
 	progress := func(total, now, utotal, unow float64, udata interface{}) bool {
+		// Returning false will abort the transfer
+		if ctx.Err() != nil {
+			return false
+		}
 		pbar.Total = int64(total)
 		pbar.Set64(int64(now))
 		pbar.Update()
@@ -154,7 +159,7 @@ func (s *SimpleSource) download(destination string) error {
 }
 
 // Fetch will download the given source and cache it locally
-func (s *SimpleSource) Fetch() error {
+func (s *SimpleSource) Fetch(ctx context.Context) error {
 	// Now go and download it
 	log.WithFields(log.Fields{
 		"uri": s.URI,
@@ -170,7 +175,11 @@ func (s *SimpleSource) Fetch() error {
 	}
 
 	// Grab the file
-	if err := s.download(destPath); err != nil {
+	if err := s.download(ctx, destPath); err != nil {
+		os.Remove(destPath)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return err
 	}
 
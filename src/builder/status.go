@@ -0,0 +1,144 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package builder
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StatusSuffix replaces the .lock suffix of a lockfile to form the path of
+// the status file describing the operation holding the lock.
+const StatusSuffix = ".status"
+
+// LockStartGrace is how long a lockfile may exist before its owner has
+// written its PID to it, before we consider the owner to have gone away.
+const LockStartGrace = time.Minute
+
+// A LockStatus describes the operation holding one of the image or overlay
+// lockfiles.
+type LockStatus struct {
+	LockPath  string    `json:"-"`
+	Operation string    `json:"operation"`         // i.e. building, updating
+	Profile   string    `json:"profile"`           // Profile or image in use
+	Package   string    `json:"package,omitempty"` // Package, if any
+	Phase     string    `json:"phase,omitempty"`   // Current build phase
+	Started   time.Time `json:"started"`
+
+	PID      int    `json:"-"` // Owner of the lockfile
+	Process  string `json:"-"` // Executable of the owner
+	Dead     bool   `json:"-"` // Whether the owner has gone away
+	Starting bool   `json:"-"` // Whether the owner has yet to write its PID
+}
+
+// StatusPath returns the path of the status file for the given lockfile
+func StatusPath(lockPath string) string {
+	return strings.TrimSuffix(lockPath, ".lock") + StatusSuffix
+}
+
+// Write will store the status next to its lockfile
+func (s *LockStatus) Write() error {
+	blob, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(StatusPath(s.LockPath), blob, 00644)
+}
+
+// Remove will delete the status file
+func (s *LockStatus) Remove() error {
+	if err := os.Remove(StatusPath(s.LockPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// isStartingLock will determine whether the lockfile was only just created,
+// as the lockfile is created before the owner writes its PID to it.
+func isStartingLock(lockPath string, pid int) bool {
+	if pid > 0 {
+		return false
+	}
+	st, err := os.Stat(lockPath)
+	return err == nil && time.Since(st.ModTime()) < LockStartGrace
+}
+
+// ReadLockStatus will return the status of the given lockfile. If the owner
+// didn't leave a status file behind, what we can be learned from the path of
+// the lockfile is returned instead.
+func ReadLockStatus(lockPath string) (*LockStatus, error) {
+	lock, err := ReadLockFile(lockPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &LockStatus{}
+	if blob, err := ioutil.ReadFile(StatusPath(lockPath)); err == nil {
+		json.Unmarshal(blob, s)
+	}
+	s.LockPath = lockPath
+	s.PID = lock.GetOwnerPID()
+
+	s.Starting = isStartingLock(lockPath, s.PID)
+	s.Dead = !s.Starting && lock.IsDead()
+	if !s.Dead && !s.Starting {
+		s.Process = lock.GetOwnerProcess()
+	}
+
+	name := strings.TrimSuffix(filepath.Base(lockPath), ".lock")
+	if s.Profile == "" {
+		if filepath.Dir(lockPath) == ImagesDir {
+			s.Profile = name
+		} else {
+			// i.e. /var/cache/solbuild/unstable-x86_64/nano.lock
+			s.Profile = filepath.Base(filepath.Dir(lockPath))
+			s.Package = name
+		}
+	}
+	if s.Started.IsZero() {
+		if st, err := os.Stat(lockPath); err == nil {
+			s.Started = st.ModTime()
+		}
+	}
+	return s, nil
+}
+
+// ListLockStatus will return the status of every image and overlay lockfile.
+// Lockfiles removed while we're listing them are skipped, as their operation
+// has simply finished.
+func ListLockStatus() ([]*LockStatus, error) {
+	locks, err := findLockFiles()
+	if err != nil {
+		return nil, err
+	}
+	var ret []*LockStatus
+	for _, l := range locks {
+		s, err := ReadLockStatus(l)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
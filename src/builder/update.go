@@ -70,13 +70,30 @@ func (b *BackingImage) updatePackages(notif PidNotifier, pkgManager *EopkgManage
 	return nil
 }
 
-// Update will attempt to update the backing image to the latest version
-// internally.
-func (b *BackingImage) Update(notif PidNotifier, pkgManager *EopkgManager) error {
+// ImageStagingSuffix is appended to the image path to form the path of the
+// copy that is updated.
+const ImageStagingSuffix = ".staging"
+
+// unmountRoot will tear down everything mounted in the root for the update
+func (b *BackingImage) unmountRoot(pkgManager *EopkgManager) error {
 	mountMan := disk.GetMountManager()
-	log.WithFields(log.Fields{
-		"image": b.Name,
-	}).Debug("Updating backing image")
+	pkgManager.Cleanup()
+	MurderDeathKill(b.RootDir)
+	if err := mountMan.Unmount(filepath.Join(b.RootDir, "proc")); err != nil {
+		return err
+	}
+	return mountMan.Unmount(b.RootDir)
+}
+
+// modifyStaged will mount a staging copy of the image read-write and run fn
+// to modify it. If prepare is set, it is first run on the path of the copy
+// before it is mounted. The build user is then added if needed, and once the copy has
+// been validated it replaces the image, so a failed or interrupted
+// modification leaves the image untouched. The replaced image is kept as a
+// snapshot when KeepSnapshots is set.
+func (b *BackingImage) modifyStaged(notif PidNotifier, pkgManager *EopkgManager, prepare func(string) error, fn func() error) error {
+	mountMan := disk.GetMountManager()
+	staging := b.ImagePath + ImageStagingSuffix
 
 	if !PathExists(b.RootDir) {
 		if err := os.MkdirAll(b.RootDir, 00755); err != nil {
@@ -91,14 +108,39 @@ func (b *BackingImage) Update(notif PidNotifier, pkgManager *EopkgManager) error
 	}
 
 	log.WithFields(log.Fields{
-		"image": b.ImagePath,
+		"image":   b.ImagePath,
+		"staging": staging,
+	}).Debug("Creating staging copy of image")
+	if err := CopyImage(b.ImagePath, staging); err != nil {
+		log.WithFields(log.Fields{
+			"image": b.ImagePath,
+			"error": err,
+		}).Error("Failed to create staging copy of image")
+		return err
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			os.Remove(staging)
+		}
+	}()
+
+	if prepare != nil {
+		if err := prepare(staging); err != nil {
+			return err
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"image": staging,
 		"root":  b.RootDir,
 	}).Debug("Mounting rootfs")
 
 	// Mount the rootfs
-	if err := mountMan.Mount(b.ImagePath, b.RootDir, "auto", "loop"); err != nil {
+	if err := mountMan.Mount(staging, b.RootDir, "auto", "loop"); err != nil {
 		log.WithFields(log.Fields{
-			"image": b.ImagePath,
+			"image": staging,
 			"error": err,
 		}).Error("Failed to mount rootfs")
 		return err
@@ -106,7 +148,7 @@ func (b *BackingImage) Update(notif PidNotifier, pkgManager *EopkgManager) error
 
 	if err := EnsureEopkgLayout(b.RootDir); err != nil {
 		log.WithFields(log.Fields{
-			"image": b.ImagePath,
+			"image": staging,
 			"error": err,
 		}).Error("Failed to fix filesystem layout")
 		return err
@@ -125,8 +167,7 @@ func (b *BackingImage) Update(notif PidNotifier, pkgManager *EopkgManager) error
 		return err
 	}
 
-	// Hand over to package management to do the updates
-	if err := b.updatePackages(notif, pkgManager); err != nil {
+	if err := fn(); err != nil {
 		return err
 	}
 
@@ -135,9 +176,67 @@ func (b *BackingImage) Update(notif PidNotifier, pkgManager *EopkgManager) error
 		return err
 	}
 
+	log.Debug("Validating modified image")
+	if err := ValidateRoot(notif, b.RootDir); err != nil {
+		log.WithFields(log.Fields{
+			"image": b.Name,
+			"error": err,
+		}).Error("Modified image is not valid, keeping the previous image")
+		return err
+	}
+
+	// The image must be clean before builds may use it
+	if err := b.unmountRoot(pkgManager); err != nil {
+		log.WithFields(log.Fields{
+			"root":  b.RootDir,
+			"error": err,
+		}).Error("Failed to unmount modified image")
+		return err
+	}
+
+	if b.KeepSnapshots > 0 {
+		if _, err := b.Snapshot(b.KeepSnapshots); err != nil {
+			log.WithFields(log.Fields{
+				"image": b.Name,
+				"error": err,
+			}).Error("Failed to take snapshot of image")
+			return err
+		}
+	}
+
+	if err := os.Rename(staging, b.ImagePath); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+// Update will attempt to update the backing image to the latest version
+// internally.
+//
+// The update is performed on a staging copy of the image, which replaces the
+// image only once it has been validated, so a failed or interrupted update
+// leaves the image untouched.
+func (b *BackingImage) Update(notif PidNotifier, pkgManager *EopkgManager) error {
+	log.WithFields(log.Fields{
+		"image": b.Name,
+	}).Debug("Updating backing image")
+
+	// Hand over to package management to do the updates
+	inspected := &ImageMetadata{}
+	err := b.modifyStaged(notif, pkgManager, nil, func() error {
+		if err := b.updatePackages(notif, pkgManager); err != nil {
+			return err
+		}
+		return inspected.inspectRoot(b.RootDir)
+	})
+	if err != nil {
+		return err
+	}
+
 	log.WithFields(log.Fields{
 		"profile": b.Name,
 	}).Debug("Image successfully updated")
 
-	return nil
+	return b.recordUpdate(inspected)
 }
@@ -19,6 +19,7 @@ package builder
 import (
 	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -148,3 +149,38 @@ func ParseGroups(grps string) (map[string]*Group, error) {
 	}
 	return ret, nil
 }
+
+// RemoveEntries will remove the user and group of the given name from the
+// passwd, shadow, group and gshadow files found in path.
+func RemoveEntries(path, name string) error {
+	for _, file := range []string{"passwd", "shadow", "group", "gshadow"} {
+		if err := removeEntry(filepath.Join(path, file), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEntry will rewrite the file without the lines for the given name,
+// leaving missing files alone.
+func removeEntry(path, name string) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, line := range strings.SplitAfter(string(blob), "\n") {
+		if strings.HasPrefix(line, name+":") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(kept, "")), st.Mode())
+}
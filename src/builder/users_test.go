@@ -17,6 +17,9 @@
 package builder
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -76,3 +79,38 @@ func TestPasswd(t *testing.T) {
 		t.Fatalf("Myseriously have members of lightdm: |%s| %d", strings.Join(lightdm.Members, ", "), len(lightdm.Members))
 	}
 }
+
+func TestRemoveEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "solbuild-users")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, file := range []string{"passwd", "group"} {
+		blob, err := ioutil.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", file, err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), blob, 00644); err != nil {
+			t.Fatalf("Failed to write %s: %v", file, err)
+		}
+	}
+
+	if err := RemoveEntries(dir, "lightdm"); err != nil {
+		t.Fatalf("Failed to remove entries: %v", err)
+	}
+	pwd, err := NewPasswd(dir)
+	if err != nil {
+		t.Fatalf("Unable to parse passwd data after removal: %v", err)
+	}
+	if _, ok := pwd.Users["lightdm"]; ok {
+		t.Fatalf("User should have been removed")
+	}
+	if _, ok := pwd.Groups["lightdm"]; ok {
+		t.Fatalf("Group should have been removed")
+	}
+	if len(pwd.Users) != 18 || len(pwd.Groups) != 47 {
+		t.Fatalf("Only the named entries should be removed: %d users, %d groups", len(pwd.Users), len(pwd.Groups))
+	}
+}
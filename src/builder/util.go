@@ -17,25 +17,33 @@
 package builder
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/solus-project/libosdev/commands"
 	"github.com/solus-project/libosdev/disk"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unsafe"
 )
 
 var (
 	// ChrootEnvironment is the env used by ChrootExec calls
 	ChrootEnvironment []string
+
+	// StopGracePeriod is how long processes are given to exit after being
+	// asked to terminate, before they're killed outright.
+	StopGracePeriod = 10 * time.Second
 )
 
 func init() {
@@ -47,6 +55,63 @@ type PidNotifier interface {
 	SetActivePID(int)
 }
 
+// An OutputNotifier may optionally be implemented by a PidNotifier to
+// redirect the output of the processes it is notified about.
+type OutputNotifier interface {
+	GetOutput() (stdout io.Writer, stderr io.Writer)
+}
+
+// A ContextNotifier may optionally be implemented by a PidNotifier to allow
+// the processes it is notified about to be killed when the context is done.
+type ContextNotifier interface {
+	Context() context.Context
+}
+
+// getContext will return the context of the notifier, if it has one
+func getContext(notif PidNotifier) context.Context {
+	if c, ok := notif.(ContextNotifier); ok {
+		return c.Context()
+	}
+	return context.Background()
+}
+
+// waitContext will wait for the command to complete. If the context is done
+// first the process group led by it is asked to terminate, and is killed if
+// it is still around after the StopGracePeriod.
+func waitContext(ctx context.Context, c *exec.Cmd) error {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		syscall.Kill(-c.Process.Pid, syscall.SIGTERM)
+		c.Process.Signal(syscall.SIGTERM)
+		select {
+		case <-time.After(StopGracePeriod):
+			syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+			c.Process.Kill()
+		case <-done:
+		}
+	}()
+	err := c.Wait()
+	close(done)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// getOutput will return the output streams requested by the notifier, or
+// the standard output and error streams if it has no preference.
+func getOutput(notif PidNotifier) (io.Writer, io.Writer) {
+	if o, ok := notif.(OutputNotifier); ok {
+		return o.GetOutput()
+	}
+	return os.Stdout, os.Stderr
+}
+
 // ActivateRoot will do the hard work of actually bring up the overlayfs
 // system to allow manipulation of the roots for builds, etc.
 func (p *Package) ActivateRoot(overlay *Overlay) error {
@@ -189,35 +254,66 @@ func SaneEnvironment(username, home string) []string {
 // so that we can store the PID, for long running tasks
 func ChrootExec(notif PidNotifier, dir, command string) error {
 	args := []string{dir, "/bin/sh", "-c", command}
-	c := exec.Command("chroot", args...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
+	c := cgroupCommand(cgroupPath(notif), "chroot", args...)
+	c.Stdout, c.Stderr = getOutput(notif)
 	c.Stdin = nil
 	c.Env = ChrootEnvironment
 	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 
+	ctx := getContext(notif)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err := c.Start(); err != nil {
 		return err
 	}
 	notif.SetActivePID(c.Process.Pid)
-	return c.Wait()
+	return waitContext(ctx, c)
+}
+
+// isTerminal will determine whether the file is a terminal
+func isTerminal(f *os.File) bool {
+	var t syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&t)))
+	return errno == 0
+}
+
+// reclaimTerminal will make our process group the foreground of the terminal
+// again, once a command that was given the terminal has exited.
+func reclaimTerminal(f *os.File) {
+	// Taking the terminal from the background would otherwise stop us
+	signal.Ignore(syscall.SIGTTOU)
+	defer signal.Reset(syscall.SIGTTOU)
+	pgrp := int32(syscall.Getpgrp())
+	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TIOCSPGRP, uintptr(unsafe.Pointer(&pgrp)))
 }
 
 // ChrootExecStdin is almost identical to ChrootExec, except it permits a stdin
-// to be associated with the command
+// to be associated with the command. The command is run in its own process
+// group, so that it can be stopped along with its children, which is given
+// the terminal while it runs.
 func ChrootExecStdin(notif PidNotifier, dir, command string) error {
 	args := []string{dir, "/bin/sh", "-c", command}
-	c := exec.Command("chroot", args...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
+	c := cgroupCommand(cgroupPath(notif), "chroot", args...)
+	c.Stdout, c.Stderr = getOutput(notif)
 	c.Stdin = os.Stdin
 	c.Env = ChrootEnvironment
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if isTerminal(os.Stdin) {
+		c.SysProcAttr.Foreground = true
+		c.SysProcAttr.Ctty = int(os.Stdin.Fd())
+		defer reclaimTerminal(os.Stdin)
+	}
 
+	ctx := getContext(notif)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err := c.Start(); err != nil {
 		return err
 	}
 	notif.SetActivePID(c.Process.Pid)
-	return c.Wait()
+	return waitContext(ctx, c)
 }
 
 // AddBuildUser will attempt to add the solbuild user & group if they've not
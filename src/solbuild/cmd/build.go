@@ -18,16 +18,18 @@ package cmd
 
 import (
 	"builder"
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"os"
 	"strings"
+	"time"
 )
 
 var buildCmd = &cobra.Command{
-	Use:   "build [package.yml|pspec.xml]",
+	Use:   "build [package.yml|pspec.xml|git+url#ref[:subdir]]",
 	Short: "build a package",
 	Long: `Build the given package in a chroot environment, and upon success,
 store those packages in the current directory`,
@@ -37,11 +39,29 @@ store those packages in the current directory`,
 var tmpfs bool
 var tmpfsSize string
 var manifest string
+var eventsJSON string
+var buildLog bool
+var verifyBuild bool
+var verifyVary []string
+var timezone string
+var buildDir string
+var keepOnFailure bool
+var buildReport bool
+var buildTimeout time.Duration
 
 func init() {
 	buildCmd.Flags().BoolVarP(&tmpfs, "tmpfs", "t", false, "Enable building in a tmpfs")
 	buildCmd.Flags().StringVarP(&tmpfsSize, "memory", "m", "", "Set the tmpfs size to use")
 	buildCmd.Flags().StringVarP(&manifest, "transit-manifest", "", "", "Create transit manifest for the given target")
+	buildCmd.Flags().BoolVarP(&buildLog, "log", "l", false, "Keep a log of the build alongside the packages")
+	buildCmd.Flags().StringVarP(&eventsJSON, "events-json", "", "", "Write build events as JSON lines to the given file (- for stdout)")
+	buildCmd.Flags().DurationVarP(&buildTimeout, "timeout", "", 0, "Stop the build if it takes longer than the given duration, i.e. 2h")
+	buildCmd.Flags().BoolVarP(&buildReport, "report", "", false, "Write a timing and resource report alongside the packages")
+	buildCmd.Flags().BoolVarP(&keepOnFailure, "keep-on-failure", "", false, "Keep the build root for inspection if the build fails")
+	buildCmd.Flags().BoolVarP(&verifyBuild, "verify-reproducible", "", false, "Build twice and compare the resulting packages")
+	buildCmd.Flags().StringSliceVarP(&verifyVary, "vary", "", nil, "Vary tmpfs, timezone and/or path in the second verification build")
+	buildCmd.Flags().StringVarP(&timezone, "timezone", "", "", "Set the timezone used within the build")
+	buildCmd.Flags().StringVarP(&buildDir, "build-dir", "", "", "Build within the named directory of the build user's home")
 	RootCmd.AddCommand(buildCmd)
 }
 
@@ -65,15 +85,23 @@ func buildPackage(cmd *cobra.Command, args []string) error {
 		os.Exit(1)
 	}
 
+	if verifyBuild {
+		if err := verifyReproducible(strings.TrimSpace(pkgPath)); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		return nil
+	}
+
 	// Initialise the build manager
 	manager, err := builder.NewManager()
 	if err != nil {
-		return nil
+		os.Exit(1)
 	}
 
 	// Safety first..
 	if err = manager.SetProfile(profile); err != nil {
-		return nil
+		os.Exit(1)
 	}
 
 	pkgPath = strings.TrimSpace(pkgPath)
@@ -82,11 +110,51 @@ func buildPackage(cmd *cobra.Command, args []string) error {
 		return errors.New("Require a filename to build")
 	}
 
+	if !runBuild(manager, pkgPath) {
+		os.Exit(1)
+	}
+
+	log.Info("Building succeeded")
+
+	return nil
+}
+
+// runBuild will load and build the package, returning whether it succeeded.
+// Exiting only once this returns ensures the signal handling is stopped and
+// the events file is closed, however the build ends.
+func runBuild(manager *builder.Manager, pkgPath string) bool {
+	ctx, stop := cancelOnSignal(manager)
+	defer stop()
+
+	// Only the events may go to stdout when streamed there, so the output
+	// of the build, downloads and git fetches is sent to stderr instead
+	events := os.Stdout
+	if eventsJSON == "-" {
+		os.Stdout = os.Stderr
+	}
+
+	var err error
+	commit := ""
+	if builder.IsGitPackage(pkgPath) {
+		var g *builder.GitPackage
+		if g, pkgPath, commit, err = fetchGitPackage(ctx, pkgPath); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to fetch package: %v\n", err)
+			return false
+		}
+		defer g.Unlock()
+	}
+
 	pkg, err := builder.NewPackage(pkgPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load package: %v\n", err)
-		return nil
+		return false
 	}
+	if err := pkg.SetBuildDir(buildDir); err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %s\n", err, buildDir)
+		return false
+	}
+	pkg.Timezone = timezone
+	pkg.Commit = commit
 
 	manager.SetManifestTarget(manifest)
 
@@ -95,16 +163,62 @@ func buildPackage(cmd *cobra.Command, args []string) error {
 		if err == builder.ErrProfileNotInstalled {
 			fmt.Fprintf(os.Stderr, "%v: Did you forget to init?\n", err)
 		}
-		return nil
+		return false
 	}
 
+	// Stream events out if requested
+	if eventsJSON != "" {
+		w := events
+		if eventsJSON != "-" {
+			if w, err = os.Create(eventsJSON); err != nil {
+				log.WithFields(log.Fields{
+					"path":  eventsJSON,
+					"error": err,
+				}).Error("Failed to create events file")
+				return false
+			}
+			defer w.Close()
+		}
+		manager.AddSubscriber(builder.NewJSONEventWriter(w))
+	}
+
+	manager.SetBuildLog(buildLog)
+	manager.SetKeepOnFailure(keepOnFailure)
+	manager.SetReport(buildReport)
+	manager.SetTimeout(buildTimeout)
 	manager.SetTmpfs(tmpfs, tmpfsSize)
-	if err := manager.Build(); err != nil {
+
+	if err := manager.Build(ctx); err != nil {
+		if err == builder.ErrTimeout || err == builder.ErrInterrupted {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
 		log.Error("Failed to build packages")
-		return nil
+		return false
 	}
 
-	log.Info("Building succeeded")
+	return true
+}
 
-	return nil
+// fetchGitPackage will lock the repository of the git+ build argument and
+// check it out, returning the path of the spec to build and the commit it was
+// found at. The repository remains locked until the build is done.
+func fetchGitPackage(ctx context.Context, arg string) (*builder.GitPackage, string, string, error) {
+	g, err := builder.ParseGitPackage(arg)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := g.Lock(ctx); err != nil {
+		return nil, "", "", err
+	}
+	path, commit, err := g.Fetch(ctx)
+	if err != nil {
+		g.Unlock()
+		return nil, "", "", err
+	}
+	log.WithFields(log.Fields{
+		"uri":    g.URI,
+		"ref":    g.Ref,
+		"commit": commit,
+	}).Info("Building from git")
+	return g, path, commit, nil
 }
@@ -0,0 +1,376 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var buildManyCmd = &cobra.Command{
+	Use:   "build-many [package.yml|pspec.xml|directory]...",
+	Short: "build multiple packages",
+	Long: `Build each of the given packages in turn, storing the resulting packages
+in the current directory. Any directories passed will be searched for
+package.yml and pspec.xml files. A summary of all builds is printed once
+they have completed.`,
+	RunE: buildMany,
+}
+
+// Whether we continue past failed builds
+var keepGoing bool
+
+// Whether to build in dependency order, feeding the local repo as we go
+var orderedBuild bool
+
+// Local repo to feed in an ordered build
+var orderedRepo string
+
+// Maximum number of builds to run at once
+var buildJobs int
+
+func init() {
+	buildManyCmd.Flags().BoolVarP(&tmpfs, "tmpfs", "t", false, "Enable building in a tmpfs")
+	buildManyCmd.Flags().StringVarP(&tmpfsSize, "memory", "m", "", "Set the tmpfs size to use")
+	buildManyCmd.Flags().BoolVarP(&buildLog, "log", "l", false, "Keep a log of each build alongside the packages")
+	buildManyCmd.Flags().DurationVarP(&buildTimeout, "timeout", "", 0, "Stop each build that takes longer than the given duration")
+	buildManyCmd.Flags().BoolVarP(&buildReport, "report", "", false, "Write a timing and resource report for each build")
+	buildManyCmd.Flags().BoolVarP(&keepOnFailure, "keep-on-failure", "", false, "Keep the build root of each failed build for inspection")
+	buildManyCmd.Flags().BoolVarP(&keepGoing, "keep-going", "k", false, "Continue building after a failed build")
+	buildManyCmd.Flags().BoolVarP(&orderedBuild, "ordered", "o", false, "Build in dependency order, adding packages to the local repo")
+	buildManyCmd.Flags().StringVarP(&orderedRepo, "repo", "r", "", "Local repo of the profile to add packages to")
+	buildManyCmd.Flags().IntVarP(&buildJobs, "jobs", "j", 1, "Number of packages to build at once")
+	RootCmd.AddCommand(buildManyCmd)
+}
+
+// A batchBuild is a single package build within a larger set of builds
+type batchBuild struct {
+	Path     string           // Path to the build spec
+	Package  *builder.Package // Parsed package, if it could be loaded
+	Error    error            // Failure, if any
+	Built    bool             // Whether the build was attempted at all
+	Duration time.Duration    // Time spent building
+	Output   string           // Separate output file for a parallel build
+}
+
+// Status returns a human readable status for the build summary
+func (b *batchBuild) Status() string {
+	if !b.Built {
+		if b.Error != nil {
+			return "error"
+		}
+		return "skipped"
+	}
+	if b.Error != nil {
+		return "failed"
+	}
+	return "ok"
+}
+
+// Name returns the package name, or the spec path if it couldn't be parsed
+func (b *batchBuild) Name() string {
+	if b.Package != nil {
+		return b.Package.Name
+	}
+	return b.Path
+}
+
+// findSpecs will walk the given directory looking for build specs. Where a
+// directory contains both a package.yml and a pspec.xml, only the package.yml
+// is used, as with the build command.
+func findSpecs(dir string) ([]string, error) {
+	var specs []string
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != dir && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		switch info.Name() {
+		case "package.yml":
+			specs = append(specs, path)
+		case "pspec.xml":
+			if !builder.PathExists(filepath.Join(filepath.Dir(path), "package.yml")) {
+				specs = append(specs, path)
+			}
+		}
+		return nil
+	})
+	return specs, err
+}
+
+// collectSpecs will turn the command line arguments into a list of specs
+func collectSpecs(args []string) ([]string, error) {
+	var specs []string
+
+	for _, arg := range args {
+		arg = strings.TrimSpace(arg)
+		st, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		// Child builds may not run in our working directory
+		if arg, err = filepath.Abs(arg); err != nil {
+			return nil, err
+		}
+		if !st.IsDir() {
+			specs = append(specs, arg)
+			continue
+		}
+		found, err := findSpecs(arg)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, found...)
+	}
+	return specs, nil
+}
+
+// childBuildArgs returns the command line used to build the given spec in
+// a child solbuild process, passing through all relevant options.
+func childBuildArgs(path string, useTmpfs bool) []string {
+	args := []string{"build", path}
+	if profile != "" {
+		args = append(args, "-p", profile)
+	}
+	if CLIDebug {
+		args = append(args, "-d")
+	}
+	if builder.DisableColors || buildJobs > 1 {
+		args = append(args, "-n")
+	}
+	if useTmpfs {
+		args = append(args, "-t")
+	}
+	if tmpfsSize != "" {
+		args = append(args, "-m", tmpfsSize)
+	}
+	if buildLog {
+		args = append(args, "-l")
+	}
+	if keepOnFailure {
+		args = append(args, "--keep-on-failure")
+	}
+	if buildReport {
+		args = append(args, "--report")
+	}
+	if buildTimeout > 0 {
+		args = append(args, "--timeout", buildTimeout.String())
+	}
+	return args
+}
+
+// newChild will return the command to run solbuild again with the given
+// arguments, from within the given directory. If out is nil, the output of
+// the child is passed straight through to our own.
+func newChild(dir string, args []string, out io.Writer) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	c := exec.Command(exe, args...)
+	c.Dir = dir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	if out != nil {
+		c.Stdout = out
+		c.Stderr = out
+	}
+	c.Stdin = nil
+	// Signals reach the child through forwardSignals only, so that CTRL+C
+	// isn't seen twice by the child.
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return c, nil
+}
+
+// runChild will run solbuild again with the given arguments, from within
+// the given directory, and wait for it to complete.
+func runChild(dir string, args []string, out io.Writer) error {
+	c, err := newChild(dir, args, out)
+	if err != nil {
+		return err
+	}
+	if err := startChild(c); err != nil {
+		return err
+	}
+	defer endChild(c.Process)
+	return c.Wait()
+}
+
+// openBuildOutput will create the file in the current directory that holds
+// all output of the given build. This is only used when builds run in
+// parallel, as their output would otherwise be interleaved.
+func openBuildOutput(b *batchBuild) (*os.File, error) {
+	path, err := filepath.Abs(b.Name() + ".output")
+	if err != nil {
+		return nil, err
+	}
+	fd, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	usr := builder.GetUserInfo()
+	if err := fd.Chown(usr.UID, usr.GID); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"file":  path,
+		}).Error("Error in restoring file ownership")
+	}
+	b.Output = path
+	return fd, nil
+}
+
+// runChildBuild will build the spec with a fresh solbuild process, which
+// will collect the packages into the given directory.
+//
+// Each build must have a fresh Manager, and once a build has dropped the
+// networking namespace there is no going back, so the only safe way to do
+// this is to run each build in its own process.
+func runChildBuild(b *batchBuild, dir string, out io.Writer) error {
+	return runChild(dir, childBuildArgs(b.Path, tmpfs), out)
+}
+
+// withBuildOutput will run fn with the output stream to use for the build,
+// which is nil unless we're running multiple builds at once.
+func withBuildOutput(b *batchBuild, fn func(out io.Writer) error) error {
+	if buildJobs < 2 {
+		return fn(nil)
+	}
+	fd, err := openBuildOutput(b)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	log.WithFields(log.Fields{
+		"package": b.Name(),
+		"output":  b.Output,
+	}).Debug("Writing build output to file")
+	return fn(fd)
+}
+
+// printBuildSummary will emit a table of all builds and their outcomes
+func printBuildSummary(builds []*batchBuild) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "\nPACKAGE\tSTATUS\tDURATION\tSPEC\tOUTPUT\n")
+	for _, b := range builds {
+		dur := "-"
+		if b.Built {
+			dur = b.Duration.Round(time.Second).String()
+		}
+		output := "-"
+		if b.Output != "" {
+			output = b.Output
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", b.Name(), b.Status(), dur, b.Path, output)
+	}
+	w.Flush()
+}
+
+func buildMany(cmd *cobra.Command, args []string) error {
+	if CLIDebug {
+		log.SetLevel(log.DebugLevel)
+	}
+	log.StandardLogger().Formatter.(*log.TextFormatter).DisableColors = builder.DisableColors
+
+	if len(args) < 1 {
+		return errors.New("Require at least one package or directory to build")
+	}
+	if buildJobs < 1 {
+		return errors.New("The number of jobs must be at least 1")
+	}
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintf(os.Stderr, "You must be root to run build packages\n")
+		os.Exit(1)
+	}
+
+	specs, err := collectSpecs(args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to find packages: %v\n", err)
+		os.Exit(1)
+	}
+	if len(specs) < 1 {
+		fmt.Fprintf(os.Stderr, "No packages found to build\n")
+		os.Exit(1)
+	}
+
+	var builds []*batchBuild
+	for _, spec := range specs {
+		b := &batchBuild{Path: spec}
+		b.Package, b.Error = builder.NewPackage(spec)
+		builds = append(builds, b)
+	}
+
+	stopForwarding := forwardSignals()
+	defer stopForwarding()
+
+	if orderedBuild {
+		return buildOrdered(builds)
+	}
+
+	var loaded []*batchBuild
+	failed := false
+	for _, b := range builds {
+		if b.Error != nil {
+			log.WithFields(log.Fields{
+				"path":  b.Path,
+				"error": b.Error,
+			}).Error("Failed to load package")
+			failed = true
+			continue
+		}
+		loaded = append(loaded, b)
+	}
+
+	if !failed || keepGoing {
+		sched := &buildScheduler{
+			builds: loaded,
+			jobs:   buildJobs,
+			run: func(b *batchBuild) error {
+				return withBuildOutput(b, func(out io.Writer) error {
+					return runChildBuild(b, ".", out)
+				})
+			},
+		}
+		if sched.Run() {
+			failed = true
+		}
+	}
+
+	printBuildSummary(builds)
+
+	if failed {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/solus-project/libosdev/disk"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// repoLock serialises changes to the local repo between parallel builds
+var repoLock sync.Mutex
+
+// loadBuildProfile will load the profile requested on the command line, or
+// the configured default profile.
+func loadBuildProfile() (*builder.Profile, error) {
+	name := profile
+	if name == "" {
+		config, err := builder.NewConfig()
+		if err != nil {
+			return nil, err
+		}
+		name = config.DefaultProfile
+	}
+	return builder.NewProfile(name)
+}
+
+// findLocalRepo will find the local repo in the profile that we should add
+// newly built packages to.
+func findLocalRepo(prof *builder.Profile) (*builder.Repo, error) {
+	var locals []*builder.Repo
+	for _, repo := range prof.EnabledRepos() {
+		if !repo.Local {
+			continue
+		}
+		if orderedRepo == "" || orderedRepo == repo.Name {
+			locals = append(locals, repo)
+		}
+	}
+
+	if orderedRepo != "" && len(locals) == 0 {
+		return nil, fmt.Errorf("Profile '%s' has no local repo named '%s'", prof.Name, orderedRepo)
+	}
+	if len(locals) == 0 {
+		return nil, fmt.Errorf("Profile '%s' has no local repo to add packages to", prof.Name)
+	}
+	if len(locals) > 1 {
+		return nil, fmt.Errorf("Profile '%s' has multiple local repos, choose one with --repo", prof.Name)
+	}
+	return locals[0], nil
+}
+
+// localRepoPackages returns the names of all packages already present in
+// the local repos of the profile.
+func localRepoPackages(prof *builder.Profile) map[string]bool {
+	ret := make(map[string]bool)
+	for _, repo := range prof.EnabledRepos() {
+		if !repo.Local {
+			continue
+		}
+		files, _ := filepath.Glob(filepath.Join(repo.URI, "*.eopkg"))
+		for _, f := range files {
+			ret[builder.EopkgNameFromFile(f)] = true
+		}
+	}
+	return ret
+}
+
+// checkExternalDeps will report every dependency that is satisfied by none
+// of the build set, the local repos and the repos of the backing image, before
+// anything is built. pkgconfig dependencies that match no package of the
+// build set are reported too, as they might still be built by it. A
+// dependency is only known to be missing when the
+// profile adds no remote repos of its own, otherwise it is reported as
+// unverified so that it may be fixed before a long build fails.
+func checkExternalDeps(g *builder.BuildGraph, prof *builder.Profile) bool {
+	known := localRepoPackages(prof)
+
+	if !prof.IsLocalOnly() {
+		repos, err := builder.NewBackingImage(prof.Image).RepoPackages()
+		if err != nil {
+			if err == builder.ErrImageNotInstalled {
+				fmt.Fprintf(os.Stderr, "%v: Did you forget to init?\n", err)
+			}
+			log.WithFields(log.Fields{
+				"image": prof.Image,
+				"error": err,
+			}).Error("Failed to read the repo indexes of the image")
+			return false
+		}
+		for repo, names := range repos {
+			if !prof.KeepsImageRepo(repo) {
+				continue
+			}
+			for _, name := range names {
+				known[name] = true
+			}
+		}
+	}
+
+	verified := !prof.HasRemoteRepos()
+	ok := true
+
+	for _, pkg := range g.Packages {
+		if deps := g.Unresolved(pkg); len(deps) > 0 {
+			log.WithFields(log.Fields{
+				"package":      pkg.Name,
+				"dependencies": strings.Join(deps, ", "),
+			}).Warning("pkgconfig dependencies not built by any package in the set, order is not guaranteed if they are")
+		}
+		for _, dep := range g.Missing(pkg, known) {
+			fields := log.Fields{
+				"package":    pkg.Name,
+				"dependency": dep,
+			}
+			if verified {
+				log.WithFields(fields).Error("Missing build dependency")
+				ok = false
+				continue
+			}
+			log.WithFields(fields).Warning("Build dependency not found, expected from a remote repo of the profile")
+		}
+	}
+	return ok
+}
+
+// feedLocalRepo will copy all packages from the staging directory into the
+// local repo, and copy every collected file into the current directory.
+func feedLocalRepo(staging string, repo *builder.Repo) error {
+	usr := builder.GetUserInfo()
+
+	files, err := ioutil.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		src := filepath.Join(staging, f.Name())
+
+		if strings.HasSuffix(f.Name(), ".eopkg") {
+			tgt := filepath.Join(repo.URI, f.Name())
+			log.WithFields(log.Fields{
+				"file": f.Name(),
+				"repo": repo.Name,
+			}).Debug("Adding package to local repo")
+			if err := disk.CopyFile(src, tgt); err != nil {
+				return err
+			}
+		}
+
+		if err := collectStaged(src, usr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectStaged will copy the file into the current directory, owned by the
+// user that invoked solbuild.
+func collectStaged(path string, usr *builder.UserInfo) error {
+	tgt, err := filepath.Abs(filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if err := disk.CopyFile(path, tgt); err != nil {
+		return err
+	}
+	if err := os.Chown(tgt, usr.UID, usr.GID); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"file":  filepath.Base(path),
+		}).Error("Error in restoring file ownership")
+	}
+	return nil
+}
+
+// buildOrderedPackage will build the package in a staging directory, add the
+// results to the local repo and reindex it for the next build.
+func buildOrderedPackage(b *batchBuild, repo *builder.Repo, out io.Writer) error {
+	staging, err := ioutil.TempDir("", "solbuild-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if err := runChildBuild(b, staging, out); err != nil {
+		return err
+	}
+
+	repoLock.Lock()
+	defer repoLock.Unlock()
+
+	if err := feedLocalRepo(staging, repo); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"repo": repo.Name,
+	}).Info("Reindexing local repo")
+
+	args := []string{"index", repo.URI}
+	if profile != "" {
+		args = append(args, "-p", profile)
+	}
+	if builder.DisableColors || out != nil {
+		args = append(args, "-n")
+	}
+	return runChild(".", args, out)
+}
+
+// buildOrdered will build the set of packages in dependency order, making
+// the results of each build available to the next via the local repo.
+func buildOrdered(builds []*batchBuild) error {
+	var pkgs []*builder.Package
+	buildMap := make(map[*builder.Package]*batchBuild)
+	failed := false
+
+	for _, b := range builds {
+		if b.Error != nil {
+			log.WithFields(log.Fields{
+				"path":  b.Path,
+				"error": b.Error,
+			}).Error("Failed to load package")
+			failed = true
+			continue
+		}
+		pkgs = append(pkgs, b.Package)
+		buildMap[b.Package] = b
+	}
+	if failed {
+		os.Exit(1)
+	}
+
+	prof, err := loadBuildProfile()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load profile: %v\n", err)
+		os.Exit(1)
+	}
+
+	repo, err := findLocalRepo(prof)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	graph := builder.NewBuildGraph(pkgs)
+	order, err := graph.Order()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot order builds: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !checkExternalDeps(graph, prof) {
+		fmt.Fprintf(os.Stderr, "Missing build dependencies, not building anything\n")
+		os.Exit(1)
+	}
+
+	var names []string
+	for _, pkg := range order {
+		names = append(names, pkg.Name)
+	}
+	log.WithFields(log.Fields{
+		"order": strings.Join(names, ", "),
+	}).Info("Building packages in dependency order")
+
+	var ordered []*batchBuild
+	for _, pkg := range order {
+		ordered = append(ordered, buildMap[pkg])
+	}
+
+	sched := &buildScheduler{
+		builds: ordered,
+		jobs:   buildJobs,
+		deps: func(b *batchBuild) []*batchBuild {
+			var deps []*batchBuild
+			for _, dep := range graph.Dependencies(b.Package) {
+				deps = append(deps, buildMap[dep])
+			}
+			return deps
+		},
+		run: func(b *batchBuild) error {
+			return withBuildOutput(b, func(out io.Writer) error {
+				return buildOrderedPackage(b, repo, out)
+			})
+		},
+	}
+	failed = sched.Run()
+
+	printBuildSummary(ordered)
+
+	if failed {
+		os.Exit(1)
+	}
+	return nil
+}
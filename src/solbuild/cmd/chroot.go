@@ -35,7 +35,11 @@ dependencies.`,
 	RunE: chrootPackage,
 }
 
+// Whether to resume the root kept from a failed build
+var resumeChroot bool
+
 func init() {
+	chrootCmd.Flags().BoolVarP(&resumeChroot, "resume", "", false, "Enter the root kept from a failed build")
 	RootCmd.AddCommand(chrootCmd)
 }
 
@@ -89,7 +93,18 @@ func chrootPackage(cmd *cobra.Command, args []string) error {
 		return nil
 	}
 
-	if err := manager.Chroot(); err != nil {
+	ctx, stop := cancelOnSignal(manager)
+	defer stop()
+
+	if resumeChroot {
+		err = manager.ChrootResume(ctx)
+	} else {
+		err = manager.Chroot(ctx)
+	}
+	if err != nil {
+		if err == builder.ErrNoKeptRoot {
+			fmt.Fprintf(os.Stderr, "%v: Build with --keep-on-failure first\n", err)
+		}
 		log.Error("Chroot failure")
 		return nil
 	}
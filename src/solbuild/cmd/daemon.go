@@ -0,0 +1,436 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// DaemonSocket is where the daemon listens by default
+	DaemonSocket = "/run/solbuild.sock"
+
+	// DaemonDir is where the daemon keeps the results of each job
+	DaemonDir = "/var/lib/solbuild/daemon"
+
+	// daemonQueueSize is the most jobs that may be waiting to run
+	daemonQueueSize = 256
+)
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "run a build service",
+	Long: `Accept build jobs over a Unix socket, queue them and build them with
+solbuild. The status, output and resulting packages of each job are made
+available through the same socket, allowing members of the daemon group to
+build packages without root privileges.`,
+	RunE: runDaemon,
+}
+
+var (
+	daemonSocket string // Path of the socket
+	daemonGroup  string // Group allowed to use the socket
+	daemonDir    string // Where job results are stored
+	daemonJobs   int    // Builds to run at once
+)
+
+func init() {
+	daemonCmd.Flags().StringVarP(&daemonSocket, "socket", "s", DaemonSocket, "Path of the Unix socket to listen on")
+	daemonCmd.Flags().StringVarP(&daemonGroup, "group", "g", "sudo", "Group permitted to use the socket")
+	daemonCmd.Flags().StringVarP(&daemonDir, "dir", "", DaemonDir, "Directory to store job results in")
+	daemonCmd.Flags().IntVarP(&daemonJobs, "jobs", "j", 1, "Number of builds to run at once")
+	RootCmd.AddCommand(daemonCmd)
+}
+
+// A peerConn is a connection to the socket, which knows the uid of the
+// process on the other end.
+type peerConn struct {
+	net.Conn
+	uid int
+}
+
+// A peerAddr carries the uid of the client as its address, which the server
+// hands to each request as its RemoteAddr.
+type peerAddr struct {
+	net.Addr
+	uid int
+}
+
+func (p peerAddr) String() string {
+	return fmt.Sprintf("uid:%d", p.uid)
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return peerAddr{Addr: c.Conn.RemoteAddr(), uid: c.uid}
+}
+
+// A peerListener accepts connections to the socket, recording the uid of
+// each client.
+type peerListener struct {
+	net.Listener
+}
+
+func (l *peerListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &peerConn{Conn: c, uid: peerUID(c)}, nil
+}
+
+// peerUID will return the uid of the process on the other end of the
+// socket, or -1 if it cannot be determined.
+func peerUID(c net.Conn) int {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return -1
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return -1
+	}
+	uid := -1
+	raw.Control(func(fd uintptr) {
+		if cred, err := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED); err == nil {
+			uid = int(cred.Uid)
+		}
+	})
+	return uid
+}
+
+// requestUID will return the uid of the client making the request
+func requestUID(r *http.Request) int {
+	if !strings.HasPrefix(r.RemoteAddr, "uid:") {
+		return -1
+	}
+	uid, err := strconv.Atoi(strings.TrimPrefix(r.RemoteAddr, "uid:"))
+	if err != nil {
+		return -1
+	}
+	return uid
+}
+
+// writeJSON will send the value to the client as JSON
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError will send the error to the client as JSON
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// A jobRequest is the body of a job submission
+type jobRequest struct {
+	Source  string `json:"source"`
+	Profile string `json:"profile"`
+}
+
+// checkSource will ensure the user submitting the job may build the source
+func checkSource(source string, uid int) error {
+	if builder.IsGitPackage(source) {
+		// Never let a user clone something on our filesystem as root
+		g, err := builder.ParseGitPackage(source)
+		if err != nil {
+			return err
+		}
+		if !g.IsRemote() {
+			return fmt.Errorf("Only https, ssh and git repositories may be built: %s", g.URI)
+		}
+		return nil
+	}
+	if !filepath.IsAbs(source) {
+		return fmt.Errorf("The source must be an absolute path: %s", source)
+	}
+	st, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if uid != 0 && st.Sys().(*syscall.Stat_t).Uid != uint32(uid) {
+		return fmt.Errorf("You do not own %s", source)
+	}
+	return nil
+}
+
+// daemonServer handles the API requests for the queue
+type daemonServer struct {
+	queue *jobQueue
+}
+
+// serveJobs handles requests for the collection of jobs
+func (d *daemonServer) serveJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		d.listJobs(w, r)
+	case "POST":
+		d.submitJob(w, r)
+	default:
+		methodNotAllowed(w, "GET, POST")
+	}
+}
+
+// serveJob handles requests for a single job, routing on the rest of the
+// path, i.e. /jobs/<id>/artifacts/<name>
+func (d *daemonServer) serveJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		writeError(w, http.StatusNotFound, errNoSuchJob)
+		return
+	}
+	job, err := d.queue.get(id)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	switch {
+	case len(parts) == 1:
+		switch r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, job)
+		case "DELETE":
+			d.cancelJob(w, r, job)
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+	case len(parts) == 2 && parts[1] == "log":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		d.getLog(w, r, job)
+	case len(parts) == 3 && parts[1] == "artifacts":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		d.getArtifact(w, r, job, parts[2])
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("No such resource: %s", r.URL.Path))
+	}
+}
+
+// methodNotAllowed will reject the request, listing the allowed methods
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+}
+
+func (d *daemonServer) submitJob(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	uid := requestUID(r)
+	if err := checkSource(req.Source, uid); err != nil {
+		writeError(w, http.StatusForbidden, err)
+		return
+	}
+	if req.Profile != "" {
+		if _, err := builder.NewProfile(req.Profile); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	job, err := d.queue.submit(req.Source, req.Profile, uid)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, job)
+}
+
+func (d *daemonServer) listJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, d.queue.list(requestUID(r)))
+}
+
+func (d *daemonServer) cancelJob(w http.ResponseWriter, r *http.Request, job daemonJob) {
+	switch err := d.queue.cancel(job.ID, requestUID(r)); err {
+	case nil:
+		job, _ = d.queue.get(job.ID)
+		writeJSON(w, http.StatusOK, job)
+	case errNotJobOwner:
+		writeError(w, http.StatusForbidden, err)
+	default:
+		writeError(w, http.StatusConflict, err)
+	}
+}
+
+func (d *daemonServer) getLog(w http.ResponseWriter, r *http.Request, job daemonJob) {
+	if !job.ownedBy(requestUID(r)) {
+		writeError(w, http.StatusForbidden, errNotJobOwner)
+		return
+	}
+	path := filepath.Join(job.dir, jobLogName)
+	if !builder.PathExists(path) {
+		writeError(w, http.StatusNotFound, errors.New("The job has not started"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeFile(w, r, path)
+}
+
+func (d *daemonServer) getArtifact(w http.ResponseWriter, r *http.Request, job daemonJob, name string) {
+	if !job.ownedBy(requestUID(r)) {
+		writeError(w, http.StatusForbidden, errNotJobOwner)
+		return
+	}
+	for _, a := range job.Artifacts {
+		if a == name {
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+			http.ServeFile(w, r, filepath.Join(job.dir, name))
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("No such artifact: %s", name))
+}
+
+// listenDaemon will create the socket, permitting the group to use it
+func listenDaemon(path, group string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 00755); err != nil {
+		return nil, err
+	}
+	// Only a socket left behind by an earlier daemon may be replaced
+	if st, err := os.Lstat(path); err == nil && st.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := os.FileMode(00600)
+	gid := 0
+	if group != "" {
+		grp, err := user.LookupGroup(group)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		if gid, err = strconv.Atoi(grp.Gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+		mode = 00660
+	}
+	if err := os.Chown(path, 0, gid); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func runDaemon(cmd *cobra.Command, args []string) error {
+	if CLIDebug {
+		log.SetLevel(log.DebugLevel)
+	}
+	log.StandardLogger().Formatter.(*log.TextFormatter).DisableColors = builder.DisableColors
+
+	if daemonJobs < 1 {
+		return errors.New("The number of jobs must be at least 1")
+	}
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintf(os.Stderr, "You must be root to run the daemon\n")
+		os.Exit(1)
+	}
+
+	// Job results are only for their submitters
+	if err := os.MkdirAll(daemonDir, 00700); err != nil {
+		return err
+	}
+	if err := os.Chmod(daemonDir, 00700); err != nil {
+		return err
+	}
+
+	l, err := listenDaemon(daemonSocket, daemonGroup)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"socket": daemonSocket,
+			"error":  err,
+		}).Error("Failed to listen on socket")
+		os.Exit(1)
+	}
+	defer os.Remove(daemonSocket)
+
+	queue, err := newJobQueue(daemonDir, daemonQueueSize)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"dir":   daemonDir,
+			"error": err,
+		}).Error("Failed to read job directory")
+		os.Exit(1)
+	}
+	queue.start(daemonJobs)
+
+	d := &daemonServer{queue: queue}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", d.serveJobs)
+	mux.HandleFunc("/jobs/", d.serveJob)
+
+	srv := &http.Server{Handler: mux}
+
+	// Running builds are told to stop by forwardSignals, we just need to
+	// stop accepting new ones.
+	stopForwarding := forwardSignals()
+	defer stopForwarding()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, terminationSignals...)
+	go func() {
+		<-ch
+		signal.Stop(ch)
+		srv.Shutdown(context.Background())
+	}()
+
+	log.WithFields(log.Fields{
+		"socket": daemonSocket,
+		"jobs":   daemonJobs,
+	}).Info("Accepting build jobs")
+
+	if err := srv.Serve(&peerListener{l}); err != nil && err != http.ErrServerClosed {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to serve requests")
+	}
+
+	log.Info("Waiting for running builds to stop")
+	queue.stop()
+	return nil
+}
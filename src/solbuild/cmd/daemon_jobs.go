@@ -0,0 +1,359 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// jobLogName is the file within the job directory holding the build output
+const jobLogName = "build.log"
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+var (
+	// errQueueFull is returned when no more jobs can be queued
+	errQueueFull = errors.New("The job queue is full")
+
+	// errNoSuchJob is returned for an unknown job ID
+	errNoSuchJob = errors.New("No such job")
+
+	// errNotJobOwner is returned when accessing another user's job
+	errNotJobOwner = errors.New("Only the submitter may access the job")
+
+	// errJobFinished is returned when cancelling a job that already finished
+	errJobFinished = errors.New("The job has already finished")
+
+	// errShuttingDown is returned when submitting a job during shutdown
+	errShuttingDown = errors.New("The daemon is shutting down")
+)
+
+// A daemonJob is a single build submitted to the daemon
+type daemonJob struct {
+	ID        int        `json:"id"`
+	Source    string     `json:"source"`
+	Profile   string     `json:"profile,omitempty"`
+	UID       int        `json:"uid"`
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Submitted time.Time  `json:"submitted"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Artifacts []string   `json:"artifacts,omitempty"`
+
+	dir       string      // Where the build runs and stores its results
+	proc      *os.Process // The child solbuild, while running
+	cancelled bool        // Whether the submitter cancelled the job
+	created   bool        // Whether we created the job directory
+}
+
+// ownedBy will determine whether the user may access the job, which is only
+// permitted to its submitter and root.
+func (j *daemonJob) ownedBy(uid int) bool {
+	return uid == 0 || uid == j.UID
+}
+
+// A jobQueue holds every job submitted to the daemon, and runs them in
+// child solbuild processes, as many at a time as there are workers.
+type jobQueue struct {
+	lock    sync.Mutex
+	jobs    []*daemonJob
+	byID    map[int]*daemonJob
+	pending chan *daemonJob
+	nextID  int
+	dir     string // Parent of all job directories
+	closed  bool   // Whether we've stopped accepting jobs
+	workers sync.WaitGroup
+}
+
+// newJobQueue will return a queue storing the jobs within dir, which can
+// hold up to size jobs waiting to run. Job IDs follow on from those left in
+// dir by earlier runs of the daemon, so their results are never reused.
+func newJobQueue(dir string, size int) (*jobQueue, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	nextID := 1
+	for _, e := range entries {
+		if id, err := strconv.Atoi(e.Name()); err == nil && id >= nextID {
+			nextID = id + 1
+		}
+	}
+	return &jobQueue{
+		byID:    make(map[int]*daemonJob),
+		pending: make(chan *daemonJob, size),
+		nextID:  nextID,
+		dir:     dir,
+	}, nil
+}
+
+// start will launch the given number of workers
+func (q *jobQueue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for job := range q.pending {
+				q.run(job)
+			}
+		}()
+	}
+}
+
+// stop will stop accepting jobs and wait for the workers to finish. Anything
+// still queued is cancelled.
+func (q *jobQueue) stop() {
+	q.lock.Lock()
+	for _, job := range q.jobs {
+		if job.State == jobQueued {
+			job.cancelled = true
+		}
+	}
+	q.closed = true
+	close(q.pending)
+	q.lock.Unlock()
+	q.workers.Wait()
+}
+
+// submit will queue a new job, returning a copy of it
+func (q *jobQueue) submit(source, profile string, uid int) (daemonJob, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.closed {
+		return daemonJob{}, errShuttingDown
+	}
+
+	job := &daemonJob{
+		ID:        q.nextID,
+		Source:    source,
+		Profile:   profile,
+		UID:       uid,
+		State:     jobQueued,
+		Submitted: time.Now().UTC(),
+	}
+	job.dir = filepath.Join(q.dir, strconv.Itoa(job.ID))
+
+	select {
+	case q.pending <- job:
+	default:
+		return daemonJob{}, errQueueFull
+	}
+
+	q.nextID++
+	q.jobs = append(q.jobs, job)
+	q.byID[job.ID] = job
+
+	log.WithFields(log.Fields{
+		"job":     job.ID,
+		"source":  source,
+		"profile": profile,
+		"uid":     uid,
+	}).Info("Queued build")
+	return *job, nil
+}
+
+// get will return a copy of the job with the given ID
+func (q *jobQueue) get(id int) (daemonJob, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	job, ok := q.byID[id]
+	if !ok {
+		return daemonJob{}, errNoSuchJob
+	}
+	return *job, nil
+}
+
+// list will return a copy of every job the user may access, in the order
+// they were submitted
+func (q *jobQueue) list(uid int) []daemonJob {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	ret := make([]daemonJob, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		if job.ownedBy(uid) {
+			ret = append(ret, *job)
+		}
+	}
+	return ret
+}
+
+// cancel will stop the job on behalf of the given user. A running build is
+// asked to terminate, and will clean up after itself.
+func (q *jobQueue) cancel(id, uid int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	job, ok := q.byID[id]
+	if !ok {
+		return errNoSuchJob
+	}
+	if !job.ownedBy(uid) {
+		return errNotJobOwner
+	}
+	switch job.State {
+	case jobQueued:
+		job.cancelled = true
+		job.State = jobCancelled
+	case jobRunning:
+		job.cancelled = true
+		if job.proc != nil {
+			job.proc.Signal(syscall.SIGTERM)
+		}
+	default:
+		return errJobFinished
+	}
+	log.WithFields(log.Fields{
+		"job": id,
+		"uid": uid,
+	}).Info("Cancelled build")
+	return nil
+}
+
+// jobEnvironment will return the environment for the child solbuild, so
+// that the results of the build are owned by the submitter.
+func jobEnvironment(uid int) []string {
+	env := os.Environ()
+	usr, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return env
+	}
+	return append(env,
+		"SUDO_UID="+usr.Uid,
+		"SUDO_GID="+usr.Gid,
+		"SUDO_USER="+usr.Username)
+}
+
+// finish will record the outcome of the job
+func (q *jobQueue) finish(job *daemonJob, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now().UTC()
+	job.Finished = &now
+	job.proc = nil
+
+	if files, err := ioutil.ReadDir(job.dir); err == nil && job.created {
+		for _, f := range files {
+			if f.Name() != jobLogName && f.Mode().IsRegular() {
+				job.Artifacts = append(job.Artifacts, f.Name())
+			}
+		}
+	}
+
+	switch {
+	case job.cancelled:
+		job.State = jobCancelled
+	case err != nil:
+		job.State = jobFailed
+		job.Error = err.Error()
+	default:
+		job.State = jobSucceeded
+	}
+
+	log.WithFields(log.Fields{
+		"job":   job.ID,
+		"state": job.State,
+	}).Info("Build finished")
+}
+
+// run will build the job in a child solbuild, within the job directory
+func (q *jobQueue) run(job *daemonJob) {
+	q.lock.Lock()
+	if job.cancelled {
+		job.State = jobCancelled
+		q.lock.Unlock()
+		return
+	}
+	now := time.Now().UTC()
+	job.State = jobRunning
+	job.Started = &now
+	q.lock.Unlock()
+
+	err := q.runChild(job)
+	q.finish(job, err)
+}
+
+// runChild will run the child solbuild for the job and wait for it
+func (q *jobQueue) runChild(job *daemonJob) error {
+	// Never mix our results with anything already in the directory
+	if err := os.Mkdir(job.dir, 00700); err != nil {
+		return err
+	}
+	q.lock.Lock()
+	job.created = true
+	q.lock.Unlock()
+	// Only the submitter may read the results from disk
+	if err := os.Chown(job.dir, job.UID, -1); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(filepath.Join(job.dir, jobLogName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 00600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	args := []string{"build", job.Source, "-n"}
+	if job.Profile != "" {
+		args = append(args, "-p", job.Profile)
+	}
+	if CLIDebug {
+		args = append(args, "-d")
+	}
+
+	c, err := newChild(job.dir, args, out)
+	if err != nil {
+		return err
+	}
+	c.Env = jobEnvironment(job.UID)
+
+	q.lock.Lock()
+	if job.cancelled {
+		q.lock.Unlock()
+		return nil
+	}
+	err = startChild(c)
+	if err == nil {
+		job.proc = c.Process
+	}
+	q.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	defer endChild(c.Process)
+
+	if err := c.Wait(); err != nil {
+		return fmt.Errorf("Build failed: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"time"
+)
+
+var imageCheckCmd = &cobra.Command{
+	Use:   "check [image]",
+	Short: "check the health of an image",
+	Long: `Check the filesystem of the backing image, then mount it read-only to
+verify the package database and the build user. With --repair, any problems
+found are fixed by repeating the steps that produced them.`,
+	RunE: checkImage,
+}
+
+// Whether to repair problems found by the check
+var repairImage bool
+
+func init() {
+	imageCheckCmd.Flags().BoolVarP(&repairImage, "repair", "r", false, "Attempt to repair any problems found")
+	imageCmd.AddCommand(imageCheckCmd)
+}
+
+// printImageHealth will emit a summary of the image health
+func printImageHealth(name string, h *builder.ImageHealth) {
+	fmt.Printf("Image:        %s\n", name)
+	fmt.Printf("Last updated: %s\n", h.Updated.Local().Format(time.RFC3339))
+	if h.FilesystemErrors {
+		fmt.Printf("Filesystem:   errors found, contents not checked\n")
+		return
+	}
+	fmt.Printf("Filesystem:   ok\n")
+	fmt.Printf("Packages:     %d installed\n", h.Packages)
+	if len(h.BrokenPackages) > 0 {
+		fmt.Printf("Package DB:   broken entries for %s\n", strings.Join(h.BrokenPackages, ", "))
+	} else {
+		fmt.Printf("Package DB:   ok\n")
+	}
+	if h.BuildUser != nil {
+		fmt.Printf("Build user:   %v\n", h.BuildUser)
+	} else {
+		fmt.Printf("Build user:   ok\n")
+	}
+}
+
+func checkImage(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Require the name of the image to check")
+	}
+	name := strings.TrimSpace(args[0])
+
+	if CLIDebug {
+		log.SetLevel(log.DebugLevel)
+	}
+	log.StandardLogger().Formatter.(*log.TextFormatter).DisableColors = builder.DisableColors
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintf(os.Stderr, "You must be root to check images\n")
+		os.Exit(1)
+	}
+
+	manager, err := builder.NewManager()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	ctx, stop := cancelOnSignal(manager)
+	defer stop()
+
+	h, err := manager.CheckImage(ctx, name, repairImage)
+	if h != nil {
+		printImageHealth(name, h)
+	}
+	if err != nil {
+		if err == builder.ErrInvalidImage {
+			builder.EmitImageError(name)
+		} else {
+			log.WithFields(log.Fields{
+				"image": name,
+				"error": err,
+			}).Error("Failed to check image")
+		}
+		os.Exit(1)
+	}
+	if !h.IsHealthy() {
+		os.Exit(1)
+	}
+	return nil
+}
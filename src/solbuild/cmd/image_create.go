@@ -0,0 +1,91 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+var imageCreateCmd = &cobra.Command{
+	Use:   "create [name]",
+	Short: "create a new backing image",
+	Long: `Create a new backing image by installing packages from the given
+repository, which may be a local mirror. Once created, the image may be used
+by any profile by setting its image to the name of the new image.`,
+	RunE: createImage,
+}
+
+// Recipe for the new image, filled by the flags
+var imageRecipe = builder.ImageRecipe{
+	Size:       builder.DefaultImageSize,
+	Components: builder.DefaultImageComponents,
+}
+
+func init() {
+	imageCreateCmd.Flags().StringVarP(&imageRecipe.Repo, "repo", "r", "", "URI of the eopkg index to install from")
+	imageCreateCmd.Flags().StringVarP(&imageRecipe.Size, "size", "s", imageRecipe.Size, "Size of the image file")
+	imageCreateCmd.Flags().StringSliceVarP(&imageRecipe.Components, "components", "c", imageRecipe.Components, "Components to install")
+	imageCreateCmd.Flags().StringSliceVarP(&imageRecipe.Packages, "packages", "", nil, "Additional packages to install")
+	imageCmd.AddCommand(imageCreateCmd)
+}
+
+func createImage(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Require the name of the image to create")
+	}
+	imageRecipe.Name = strings.TrimSpace(args[0])
+	if !builder.IsValidImageName(imageRecipe.Name) {
+		return fmt.Errorf("Invalid image name '%s', only letters, digits, '_' and '-' may be used", imageRecipe.Name)
+	}
+	if imageRecipe.Repo == "" {
+		return errors.New("Require a repository to install from")
+	}
+
+	if CLIDebug {
+		log.SetLevel(log.DebugLevel)
+	}
+	log.StandardLogger().Formatter.(*log.TextFormatter).DisableColors = builder.DisableColors
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintf(os.Stderr, "You must be root to create images\n")
+		os.Exit(1)
+	}
+
+	manager, err := builder.NewManager()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	ctx, stop := cancelOnSignal(manager)
+	defer stop()
+
+	if err := manager.CreateImage(ctx, &imageRecipe); err != nil {
+		log.WithFields(log.Fields{
+			"image": imageRecipe.Name,
+			"error": err,
+		}).Error("Failed to create image")
+		os.Exit(1)
+	}
+	fmt.Printf("Image %s created. Set image = \"%s\" in a profile to use it.\n", imageRecipe.Name, imageRecipe.Name)
+	return nil
+}
@@ -0,0 +1,79 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var imageListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list installed images and their snapshots",
+	Long: `List each installed backing image, along with the previous generations
+of it that were kept when it was updated.`,
+	Run: listImages,
+}
+
+func init() {
+	imageCmd.AddCommand(imageListCmd)
+}
+
+// formatSize returns a human readable form of the given size in bytes
+func formatSize(size int64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	f := float64(size)
+	i := 0
+	for ; f >= 1024 && i < len(units)-1; i++ {
+		f /= 1024
+	}
+	return fmt.Sprintf("%.1f%s", f, units[i])
+}
+
+func listImages(cmd *cobra.Command, args []string) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "IMAGE\tGENERATION\tCREATED\tSIZE\n")
+	for _, name := range builder.ImageNames() {
+		image := builder.NewBackingImage(name)
+		snapshots, err := image.Snapshots()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list snapshots of %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		if st, err := os.Stat(image.ImagePath); err == nil {
+			fmt.Fprintf(w, "%s\tcurrent\t%s\t%s\n", name, st.ModTime().Format(time.RFC3339), formatSize(st.Size()))
+		} else if len(snapshots) == 0 {
+			continue
+		}
+		for _, s := range snapshots {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", name, s.Generation, s.Created.Format(time.RFC3339), formatSize(s.Size))
+		}
+		undo, err := image.UndoSnapshot()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to list snapshots of %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		if undo != nil {
+			fmt.Fprintf(w, "%s\tundo\t%s\t%s\n", name, undo.Created.Format(time.RFC3339), formatSize(undo.Size))
+		}
+	}
+	w.Flush()
+}
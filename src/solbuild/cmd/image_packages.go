@@ -0,0 +1,98 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"encoding/json"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+var imagePackagesCmd = &cobra.Command{
+	Use:   "packages [profile]",
+	Short: "list the packages installed in an image",
+	Long: `List the name, version and release of every package installed in the
+backing image of the specified solbuild profile.`,
+	Run: listImagePackages,
+}
+
+// Whether to list the packages as JSON
+var packagesJSON bool
+
+func init() {
+	imagePackagesCmd.Flags().BoolVarP(&packagesJSON, "json", "", false, "List the packages as JSON")
+	imageCmd.AddCommand(imagePackagesCmd)
+}
+
+func listImagePackages(cmd *cobra.Command, args []string) {
+	if len(args) == 1 {
+		profile = strings.TrimSpace(args[0])
+	}
+
+	if CLIDebug {
+		log.SetLevel(log.DebugLevel)
+	}
+	log.StandardLogger().Formatter.(*log.TextFormatter).DisableColors = builder.DisableColors
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintf(os.Stderr, "You must be root to list image packages\n")
+		os.Exit(1)
+	}
+
+	manager, err := builder.NewManager()
+	if err != nil {
+		os.Exit(1)
+	}
+	if err = manager.SetProfile(profile); err != nil {
+		if err == builder.ErrProfileNotInstalled {
+			fmt.Fprintf(os.Stderr, "%v: Did you forget to init?\n", err)
+		}
+		os.Exit(1)
+	}
+
+	image := builder.NewBackingImage(manager.GetProfile().Image)
+	pkgs, err := image.Packages()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"image": image.Name,
+			"error": err,
+		}).Error("Failed to list image packages")
+		os.Exit(1)
+	}
+
+	if packagesJSON {
+		blob, err := json.MarshalIndent(pkgs, "", "    ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encode packages: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(blob))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "NAME\tVERSION\tRELEASE\n")
+	for _, p := range pkgs {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", p.Name, p.Version, p.Release)
+	}
+	w.Flush()
+}
@@ -0,0 +1,103 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"errors"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+var imageRollbackCmd = &cobra.Command{
+	Use:   "rollback [image]",
+	Short: "roll back an image to a previous generation",
+	Long: `Replace the backing image with the snapshot taken before it was last
+updated, or with the given generation. The snapshot and any newer generations
+are consumed, so rolling back again steps back a further generation. The
+replaced image is kept, and may be restored with --undo.`,
+	RunE: rollbackImage,
+}
+
+// Generation to roll back to, or 0 for the newest
+var rollbackGeneration int
+
+// Whether to undo the last rollback instead
+var rollbackUndo bool
+
+func init() {
+	imageRollbackCmd.Flags().IntVarP(&rollbackGeneration, "generation", "g", 0, "Generation to roll back to")
+	imageRollbackCmd.Flags().BoolVarP(&rollbackUndo, "undo", "u", false, "Restore the image replaced by the last rollback")
+	imageCmd.AddCommand(imageRollbackCmd)
+}
+
+func rollbackImage(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("Require the name of the image to roll back")
+	}
+	name := strings.TrimSpace(args[0])
+	if rollbackUndo && rollbackGeneration != 0 {
+		return errors.New("Cannot use --generation with --undo")
+	}
+
+	if CLIDebug {
+		log.SetLevel(log.DebugLevel)
+	}
+	log.StandardLogger().Formatter.(*log.TextFormatter).DisableColors = builder.DisableColors
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintf(os.Stderr, "You must be root to roll back images\n")
+		os.Exit(1)
+	}
+
+	manager, err := builder.NewManager()
+	if err != nil {
+		os.Exit(1)
+	}
+
+	if rollbackUndo {
+		if err := manager.UndoRollbackImage(name); err != nil {
+			emitRollbackError(name, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Rollback of image %s undone\n", name)
+		return nil
+	}
+
+	snap, err := manager.RollbackImage(name, rollbackGeneration)
+	if err != nil {
+		emitRollbackError(name, err)
+		os.Exit(1)
+	}
+	fmt.Printf("Image %s rolled back to generation %d\n", name, snap.Generation)
+	return nil
+}
+
+// emitRollbackError will report the failure to roll back the image
+func emitRollbackError(name string, err error) {
+	if err == builder.ErrInvalidImage {
+		builder.EmitImageError(name)
+		return
+	}
+	log.WithFields(log.Fields{
+		"image": name,
+		"error": err,
+	}).Error("Failed to roll back image")
+}
@@ -62,11 +62,13 @@ func indexPackages(cmd *cobra.Command, args []string) error {
 	// Initialise the build manager
 	manager, err := builder.NewManager()
 	if err != nil {
-		return nil
+		fmt.Fprintf(os.Stderr, "Failed to initialise: %v\n", err)
+		os.Exit(1)
 	}
 	// Safety first..
 	if err = manager.SetProfile(profile); err != nil {
-		return nil
+		fmt.Fprintf(os.Stderr, "Failed to set profile: %v\n", err)
+		os.Exit(1)
 	}
 
 	// Set the package
@@ -74,13 +76,16 @@ func indexPackages(cmd *cobra.Command, args []string) error {
 		if err == builder.ErrProfileNotInstalled {
 			fmt.Fprintf(os.Stderr, "%v: Did you forget to init?\n", err)
 		}
-		return nil
+		os.Exit(1)
 	}
 
 	manager.SetTmpfs(tmpfs, tmpfsSize)
-	if err := manager.Index(indexDir); err != nil {
+	ctx, stop := cancelOnSignal(manager)
+	defer stop()
+
+	if err := manager.Index(ctx, indexDir); err != nil {
 		log.Error("Index failure")
-		return nil
+		os.Exit(1)
 	}
 
 	log.Info("Indexing complete")
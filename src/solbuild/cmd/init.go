@@ -18,15 +18,12 @@ package cmd
 
 import (
 	"builder"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
 	"os"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/cheggaaa/pb"
-	"github.com/solus-project/libosdev/commands"
 	"github.com/spf13/cobra"
 )
 
@@ -48,7 +45,7 @@ func init() {
 	RootCmd.AddCommand(initCmd)
 }
 
-func doInit(manager *builder.Manager) {
+func doInit(ctx context.Context, manager *builder.Manager) {
 	prof := manager.GetProfile()
 	bk := builder.NewBackingImage(prof.Image)
 	if bk.IsInstalled() {
@@ -74,7 +71,16 @@ func doInit(manager *builder.Manager) {
 
 	// Now ensure we actually have said image
 	if !bk.IsFetched() {
-		downloadImage(bk)
+		if err := manager.FetchImage(ctx); err != nil {
+			if err == builder.ErrImageUnverified {
+				fmt.Fprintf(os.Stderr, "Set allow_unverified under [images.%s] in solbuild.conf(5) to fetch it anyway\n", bk.Name)
+			}
+			log.WithFields(log.Fields{
+				"uri":   bk.ImageURI,
+				"error": err,
+			}).Error("Failed to fetch image")
+			os.Exit(1)
+		}
 	}
 
 	// Decompress the image
@@ -83,11 +89,12 @@ func doInit(manager *builder.Manager) {
 		"target": bk.ImagePath,
 	}).Debug("Decompressing backing image")
 
-	if err := commands.ExecStdoutArgsDir(builder.ImagesDir, "unxz", []string{bk.ImagePathXZ}); err != nil {
+	if err := bk.Decompress(); err != nil {
 		log.WithFields(log.Fields{
 			"source": bk.ImagePathXZ,
 			"error":  err,
 		}).Error("Failed to decompress image")
+		os.Exit(1)
 	}
 
 	log.WithFields(log.Fields{
@@ -95,75 +102,9 @@ func doInit(manager *builder.Manager) {
 	}).Info("Profile successfully initialised")
 }
 
-// Downloads an image using net/http.
-func downloadImage(bk *builder.BackingImage) (err error) {
-	file, err := os.Create(bk.ImagePathXZ)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"path":  bk.ImagePathXZ,
-			"error": err,
-		}).Error("Failed to create file")
-		return err
-	}
-
-	defer func() {
-		if err != nil {
-			os.Remove(bk.ImagePathXZ)
-		}
-	}()
-
-	defer file.Close()
-
-	resp, err := http.Get(bk.ImageURI)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"uri":   bk.ImageURI,
-			"error": err,
-		}).Error("Failed to fetch image")
-		return err
-	}
-
-	defer resp.Body.Close()
-
-	bar := pb.New64(resp.ContentLength).SetUnits(pb.U_BYTES)
-	reader := bar.NewProxyReader(resp.Body)
-	bar.ShowSpeed = true
-	bar.Start()
-	defer bar.Finish()
-
-	bytesRemaining := resp.ContentLength
-	done := false
-	buf := make([]byte, 32*1024)
-	for !done {
-		bytesRead, err := reader.Read(buf)
-		if err == io.EOF {
-			done = true
-		} else if err != nil {
-			log.WithFields(log.Fields{
-				"uri":   bk.ImageURI,
-				"error": err,
-			}).Error("Failed to fetch image")
-			return err
-		}
-
-		_, err = file.Write(buf[:bytesRead])
-		if err != nil {
-			log.WithFields(log.Fields{
-				"uri":   bk.ImagePathXZ,
-				"error": err,
-			}).Error("Failed to write to file")
-			return err
-		}
-
-		bytesRemaining -= int64(bytesRead)
-	}
-
-	return nil
-}
-
 // doUpdate will perform an update to the image after the initial init stage
-func doUpdate(manager *builder.Manager) {
-	if err := manager.Update(); err != nil {
+func doUpdate(ctx context.Context, manager *builder.Manager) {
+	if err := manager.Update(ctx); err != nil {
 		os.Exit(1)
 	}
 }
@@ -194,9 +135,12 @@ func initProfile(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	doInit(manager)
+	ctx, stop := cancelOnSignal(manager)
+	defer stop()
+
+	doInit(ctx, manager)
 
 	if autoUpdate {
-		doUpdate(manager)
+		doUpdate(ctx, manager)
 	}
 }
@@ -0,0 +1,84 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var recoverCmd = &cobra.Command{
+	Use:   "recover",
+	Short: "clean up after crashed builds",
+	Long: `Find the mounts and lockfiles left behind by solbuild processes that are
+no longer running, kill anything still running within those mounts, unmount
+them and remove the dead lockfiles.`,
+	Run: recoverStale,
+}
+
+// Whether we only list what would be recovered
+var recoverDryRun bool
+
+func init() {
+	recoverCmd.Flags().BoolVarP(&recoverDryRun, "dry-run", "", false, "List what would be recovered without changing anything")
+	RootCmd.AddCommand(recoverCmd)
+}
+
+func recoverStale(cmd *cobra.Command, args []string) {
+	if CLIDebug {
+		log.SetLevel(log.DebugLevel)
+	}
+	log.StandardLogger().Formatter.(*log.TextFormatter).DisableColors = builder.DisableColors
+
+	if os.Geteuid() != 0 {
+		fmt.Fprintf(os.Stderr, "You must be root to recover\n")
+		os.Exit(1)
+	}
+
+	plan, err := builder.PlanRecovery()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to find stale mounts and lockfiles")
+		os.Exit(1)
+	}
+
+	if plan.IsEmpty() {
+		fmt.Println("Nothing to recover")
+		return
+	}
+
+	if recoverDryRun {
+		for _, m := range plan.Mounts {
+			fmt.Printf("Would kill processes in and unmount %s\n", m)
+		}
+		for _, l := range plan.Locks {
+			fmt.Printf("Would remove dead lockfile %s\n", l)
+		}
+		return
+	}
+
+	if err := plan.Execute(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Recovery incomplete")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,137 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"time"
+)
+
+// A buildScheduler runs a set of builds with a bounded number of them active
+// at any one time, never starting a build before its dependencies have been
+// built successfully.
+type buildScheduler struct {
+	builds []*batchBuild
+	jobs   int
+
+	// deps returns the builds that must succeed before b may start
+	deps func(b *batchBuild) []*batchBuild
+
+	// run performs the actual build
+	run func(b *batchBuild) error
+}
+
+// jobResult is passed back from a running build when it has completed
+type jobResult struct {
+	build *batchBuild
+	err   error
+}
+
+// ready determines whether b can be started now. If any of the dependencies
+// of b can never be built, then skip will be set.
+func (s *buildScheduler) ready(b *batchBuild, finished map[*batchBuild]bool) (ready bool, skip bool) {
+	if s.deps == nil {
+		return true, false
+	}
+	for _, dep := range s.deps(b) {
+		if !finished[dep] {
+			return false, false
+		}
+		if !dep.Built || dep.Error != nil {
+			return false, true
+		}
+	}
+	return true, false
+}
+
+// Run will run all of the builds, returning true if any of them failed.
+// Unless keepGoing is set, no new builds are started after a failure.
+func (s *buildScheduler) Run() bool {
+	finished := make(map[*batchBuild]bool)
+	started := make(map[*batchBuild]bool)
+	results := make(chan jobResult)
+	active := 0
+	count := 0
+	failed := false
+
+	for {
+		// Start as many builds as we're permitted to
+		for _, b := range s.builds {
+			if active >= s.jobs || (failed && !keepGoing) {
+				break
+			}
+			if started[b] {
+				continue
+			}
+			ready, skip := s.ready(b, finished)
+			if skip {
+				log.WithFields(log.Fields{
+					"package": b.Name(),
+				}).Error("Skipping package as dependency was not built")
+				started[b] = true
+				finished[b] = true
+				continue
+			}
+			if !ready {
+				continue
+			}
+
+			started[b] = true
+			active++
+			count++
+
+			log.WithFields(log.Fields{
+				"package": b.Name(),
+				"index":   fmt.Sprintf("%d/%d", count, len(s.builds)),
+			}).Info("Building package")
+
+			go func(b *batchBuild) {
+				start := time.Now()
+				err := s.run(b)
+				b.Duration = time.Since(start)
+				results <- jobResult{build: b, err: err}
+			}(b)
+		}
+
+		if active == 0 {
+			break
+		}
+
+		// Wait for the next build to complete
+		res := <-results
+		active--
+		res.build.Built = true
+		res.build.Error = res.err
+		finished[res.build] = true
+
+		if res.err != nil {
+			log.WithFields(log.Fields{
+				"package": res.build.Name(),
+				"error":   res.err,
+			}).Error("Failed to build package")
+			failed = true
+			continue
+		}
+		log.WithFields(log.Fields{
+			"package":  res.build.Name(),
+			"duration": res.build.Duration.Round(time.Second),
+		}).Info("Package built successfully")
+	}
+
+	return failed
+}
@@ -0,0 +1,146 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"context"
+	"errors"
+	log "github.com/Sirupsen/logrus"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// terminationSignals are the signals that will cause solbuild to stop what
+// it's doing and clean up after itself.
+var terminationSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// errChildInterrupted is returned when a child solbuild would be started
+// after we've been asked to terminate.
+var errChildInterrupted = errors.New("Not starting build, solbuild was interrupted")
+
+// children tracks the solbuild processes started by the multi-build commands,
+// so that termination signals can be passed on to them.
+var children = struct {
+	sync.Mutex
+	procs       map[*os.Process]bool
+	interrupted bool
+}{procs: make(map[*os.Process]bool)}
+
+// cancelOnSignal returns a context that is cancelled when solbuild receives
+// a termination signal, giving the operation in progress the StopGracePeriod
+// to stop before it is cleaned up. A second signal will kill the processes of
+// the manager immediately. The returned function must be called once the
+// operation is done.
+func cancelOnSignal(manager *builder.Manager) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 2)
+	stop := make(chan struct{})
+	signal.Notify(ch, terminationSignals...)
+
+	go func() {
+		caught := false
+		for {
+			select {
+			case sig := <-ch:
+				if caught {
+					log.WithFields(log.Fields{
+						"signal": sig,
+					}).Warning("Caught second signal, killing immediately")
+					if manager != nil {
+						manager.Kill()
+					}
+					continue
+				}
+				caught = true
+				log.WithFields(log.Fields{
+					"signal": sig,
+					"grace":  builder.StopGracePeriod,
+				}).Warning("Caught signal, cleaning up")
+				cancel()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(ch)
+		close(stop)
+		cancel()
+	}
+}
+
+// startChild will start the child solbuild process, refusing to do so if
+// we've already been asked to terminate.
+func startChild(c *exec.Cmd) error {
+	children.Lock()
+	defer children.Unlock()
+	if children.interrupted {
+		return errChildInterrupted
+	}
+	if err := c.Start(); err != nil {
+		return err
+	}
+	children.procs[c.Process] = true
+	return nil
+}
+
+// endChild will stop tracking the child solbuild process
+func endChild(p *os.Process) {
+	children.Lock()
+	defer children.Unlock()
+	delete(children.procs, p)
+}
+
+// forwardSignals will pass any termination signal on to every child solbuild
+// process, which will then clean up after itself. Each child treats a second
+// signal as a request to kill the build immediately. No further children are
+// started once a signal is received. The returned function must be called
+// once all children are done.
+func forwardSignals() func() {
+	ch := make(chan os.Signal, 2)
+	stop := make(chan struct{})
+	signal.Notify(ch, terminationSignals...)
+
+	go func() {
+		for {
+			select {
+			case sig := <-ch:
+				log.WithFields(log.Fields{
+					"signal": sig,
+				}).Warning("Caught signal, stopping all builds")
+				children.Lock()
+				children.interrupted = true
+				for p := range children.procs {
+					p.Signal(sig)
+				}
+				children.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(ch)
+		close(stop)
+	}
+}
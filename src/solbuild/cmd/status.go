@@ -0,0 +1,128 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "show running solbuild operations",
+	Long: `List the builds and image updates currently holding a solbuild lock,
+along with the process that owns each of them. Locks whose owner is no
+longer running are flagged as dead, and may be cleaned up with recover.
+The installed images are listed along with when each was last updated.`,
+	Run: showStatus,
+}
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+}
+
+// orDash will return the string, or a dash if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatAge returns a short human readable form of the age
+func formatAge(age time.Duration) string {
+	if age >= 24*time.Hour {
+		return fmt.Sprintf("%dd", int(age.Hours()/24))
+	}
+	return age.Round(time.Minute).String()
+}
+
+// printImages will list the installed images and when each was last updated
+func printImages() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "\nIMAGE\tUPDATED\tAGE\n")
+	for _, name := range builder.ImageNames() {
+		image := builder.NewBackingImage(name)
+		if !image.IsInstalled() {
+			continue
+		}
+		meta, err := image.ReadMetadata()
+		if err != nil {
+			log.WithFields(log.Fields{
+				"image": name,
+				"error": err,
+			}).Error("Failed to read image metadata")
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", name, meta.Updated.Local().Format(time.RFC3339), formatAge(time.Since(meta.Updated)))
+	}
+	w.Flush()
+}
+
+func showStatus(cmd *cobra.Command, args []string) {
+	if CLIDebug {
+		log.SetLevel(log.DebugLevel)
+	}
+	log.StandardLogger().Formatter.(*log.TextFormatter).DisableColors = builder.DisableColors
+
+	locks, err := builder.ListLockStatus()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Failed to read lockfiles")
+		os.Exit(1)
+	}
+
+	defer printImages()
+
+	if len(locks) == 0 {
+		fmt.Println("No solbuild operations are running")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "PROFILE\tPACKAGE\tOPERATION\tPHASE\tPID\tPROCESS\tSTARTED\tSTATE\n")
+	for _, s := range locks {
+		state := "running"
+		process := s.Process
+		if s.Starting {
+			state = "starting"
+		} else if s.Dead {
+			state = "dead"
+			process = ""
+		}
+		pid := "-"
+		if s.PID > 0 {
+			pid = fmt.Sprintf("%d", s.PID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Profile,
+			orDash(s.Package),
+			orDash(s.Operation),
+			orDash(s.Phase),
+			pid,
+			orDash(process),
+			s.Started.Local().Format(time.RFC3339),
+			state)
+	}
+	w.Flush()
+}
@@ -66,7 +66,10 @@ func updateProfile(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	if err := manager.Update(); err != nil {
+	ctx, stop := cancelOnSignal(manager)
+	defer stop()
+
+	if err := manager.Update(ctx); err != nil {
 		if err == builder.ErrProfileNotInstalled {
 			fmt.Fprintf(os.Stderr, "%v: Did you forget to init?\n", err)
 		}
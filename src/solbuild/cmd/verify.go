@@ -0,0 +1,139 @@
+//
+// Copyright © 2016-2017 Ikey Doherty <ikey@solus-project.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cmd
+
+import (
+	"builder"
+	"fmt"
+	log "github.com/Sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// verifyTimezone is as far from UTC as we can get, to shake out any
+	// dependency on the local time
+	verifyTimezone = "Pacific/Kiritimati"
+
+	// verifyBuildDir is the directory of the build user's home that the
+	// second build is run within
+	verifyBuildDir = "verify"
+)
+
+// verifyVariations are the aspects of the second build we know how to vary
+var verifyVariations = map[string]bool{
+	"tmpfs":    true,
+	"timezone": true,
+	"path":     true,
+}
+
+// verifyBuildArgs returns the arguments for one of the two verification
+// builds, with the requested variations applied to the second build.
+func verifyBuildArgs(path string, second bool, vary map[string]bool) []string {
+	useTmpfs := tmpfs
+	if second && vary["tmpfs"] {
+		useTmpfs = !tmpfs
+	}
+	args := childBuildArgs(path, useTmpfs)
+
+	if second && vary["timezone"] {
+		args = append(args, "--timezone", verifyTimezone)
+	} else if timezone != "" {
+		args = append(args, "--timezone", timezone)
+	}
+
+	if second && vary["path"] {
+		args = append(args, "--build-dir", verifyBuildDir)
+	} else if buildDir != "" {
+		args = append(args, "--build-dir", buildDir)
+	}
+	return args
+}
+
+// verifyReproducible will build the package twice, each time in a fresh build
+// root, and compare the resulting packages. The results of the first build are
+// kept in the current directory.
+func verifyReproducible(pkgPath string) error {
+	vary := make(map[string]bool)
+	for _, v := range verifyVary {
+		if !verifyVariations[v] {
+			return fmt.Errorf("Unknown variation '%s', expected tmpfs, timezone or path", v)
+		}
+		vary[v] = true
+	}
+
+	if pkgPath == "" {
+		return fmt.Errorf("Require a filename to build")
+	}
+	path := pkgPath
+	if !builder.IsGitPackage(pkgPath) {
+		var err error
+		if path, err = filepath.Abs(pkgPath); err != nil {
+			return err
+		}
+	}
+
+	stopForwarding := forwardSignals()
+	defer stopForwarding()
+
+	tmp, err := ioutil.TempDir("", "solbuild-verify-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	dirs := []string{filepath.Join(tmp, "first"), filepath.Join(tmp, "second")}
+	for i, dir := range dirs {
+		if err := os.Mkdir(dir, 00755); err != nil {
+			return err
+		}
+		log.WithFields(log.Fields{
+			"build": fmt.Sprintf("%d/%d", i+1, len(dirs)),
+		}).Info("Starting verification build")
+		if err := runChild(dir, verifyBuildArgs(path, i > 0, vary), nil); err != nil {
+			return fmt.Errorf("Verification build %d failed: %v", i+1, err)
+		}
+	}
+
+	diffs, err := builder.CompareBuildDirs(dirs[0], dirs[1])
+	if err != nil {
+		return fmt.Errorf("Failed to compare builds: %v", err)
+	}
+
+	files, err := ioutil.ReadDir(dirs[0])
+	if err != nil {
+		return err
+	}
+	usr := builder.GetUserInfo()
+	for _, f := range files {
+		if err := collectStaged(filepath.Join(dirs[0], f.Name()), usr); err != nil {
+			return err
+		}
+	}
+
+	if len(diffs) == 0 {
+		log.Info("Build is reproducible")
+		return nil
+	}
+
+	fmt.Printf("\nFound %d difference(s) between the builds:\n", len(diffs))
+	for _, d := range diffs {
+		fmt.Printf("  %s\n", d)
+	}
+	return fmt.Errorf("Build is not reproducible")
+}